@@ -38,4 +38,19 @@ func SetupRouter(e *gin.Engine) {
 
 	// team owner create/update
 	g.POST("/example", xapp.RegisterAPI(api.Exmaple))
+
+	// purge cached SSR pages
+	g.POST("/ssr/cache/purge", xapp.RegisterAPI(api.PurgeSSRCache))
+
+	// hot swap of the SSR bundle
+	g.GET("/ssr/bundle", xapp.RegisterAPI(api.SSRBundle))
+	g.POST("/ssr/bundle/load", xapp.RegisterAPI(api.LoadSSRBundle))
+	g.POST("/ssr/bundle/upload", xapp.RegisterAPI(api.UploadSSRBundle))
+	g.POST("/ssr/bundle/rollback", xapp.RegisterAPI(api.RollbackSSRBundle))
+
+	// render circuit breaker
+	g.GET("/ssr/breaker", xapp.RegisterAPI(api.SSRBreaker))
+
+	// renderer diagnostics
+	g.GET("/ssr/diagnostics", xapp.RegisterAPI(api.SSRDiagnostics))
 }
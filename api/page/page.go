@@ -59,6 +59,36 @@ func Resolve(ctx context.Context, rawPath, rawQuery string) (pkg.SSRPayload, int
 	return nil, http.StatusNotFound, nil
 }
 
+// RoutePattern 返回与路径匹配的 SSR 路由模式（如 /:locale/hi/:name），用作指标标签；未匹配时返回空字符串。
+func RoutePattern(rawPath string) string {
+	cleanPath := path.Clean("/" + strings.TrimPrefix(strings.TrimSpace(rawPath), "/"))
+	for _, rt := range ssrRoutes {
+		if rt.regex.MatchString(cleanPath) {
+			return rt.pattern
+		}
+	}
+	return ""
+}
+
+// PrerenderPaths 展开可预渲染的 SSR 路由：无参数的路由原样返回，仅含 :locale 的路由按给定语言展开；
+// 其他带参数的路由（如 /hi/:name）无法枚举，需要调用方给出具体路径。
+func PrerenderPaths(localeList []string) []string {
+	paths := []string{}
+	for _, rt := range ssrRoutes {
+		switch {
+		case len(rt.params) == 0:
+			paths = append(paths, rt.pattern)
+		case len(rt.params) == 1 && rt.params[0] == "locale":
+			for _, locale := range localeList {
+				if locales.IsSupported(locale) {
+					paths = append(paths, strings.Replace(rt.pattern, ":locale", locales.Normalize(locale), 1))
+				}
+			}
+		}
+	}
+	return paths
+}
+
 func handleSSRFetch(h func(*gin.Context) (pkg.SSRPayload, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		payload, err := h(c)
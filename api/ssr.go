@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+
+	"vitego/pkg"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReqPurgeSSRCache struct {
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+}
+
+type RespPurgeSSRCache struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeSSRCache 按路径或路径前缀清除已缓存的 SSR 页面
+func PurgeSSRCache(ctx *gin.Context, req ReqPurgeSSRCache) (*RespPurgeSSRCache, error) {
+	path := strings.TrimSpace(req.Path)
+	prefix := strings.TrimSpace(req.Prefix)
+	if (path == "") == (prefix == "") {
+		return nil, errors.New("exactly one of path or prefix is required")
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if path != "" {
+		if !strings.HasPrefix(path, "/") {
+			return nil, errors.New("path must start with /")
+		}
+		n, err = pkg.PurgePageCache(ctx.Request.Context(), path)
+	} else {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, errors.New("prefix must start with /")
+		}
+		n, err = pkg.PurgePageCachePrefix(ctx.Request.Context(), prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &RespPurgeSSRCache{Purged: n}, nil
+}
+
+type ReqSSRBundle struct {
+	// App 为 SSR 应用名，为空时使用默认应用
+	App string `json:"app" form:"app"`
+}
+
+type ReqLoadSSRBundle struct {
+	App string `json:"app"`
+	// Dir 为 SSR_BUNDLE_DIR 下的相对目录，内含 client/index.html 与 server/server.js
+	Dir string `json:"dir"`
+}
+
+type ReqUploadSSRBundle struct {
+	App  string                `form:"app"`
+	File *multipart.FileHeader `form:"file"`
+}
+
+// SSRBundle 返回当前及可回滚的 SSR 前端版本
+func SSRBundle(ctx *gin.Context, req ReqSSRBundle) (*pkg.BundleStatus, error) {
+	status, err := pkg.CurrentBundle(req.App)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// LoadSSRBundle 从 SSR_BUNDLE_DIR 下的目录加载新的 index.html + server.js，冒烟渲染通过后切换
+func LoadSSRBundle(ctx *gin.Context, req ReqLoadSSRBundle) (*pkg.BundleInfo, error) {
+	dir := filepath.FromSlash(strings.TrimSpace(req.Dir))
+	if dir == "" || !filepath.IsLocal(dir) {
+		return nil, errors.New("dir must be a relative path inside the bundle directory")
+	}
+
+	info, err := pkg.LoadBundle(ctx.Request.Context(), req.App, filepath.Join(pkg.BundleRoot(), dir))
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// UploadSSRBundle 上传 .zip 或 .tar.gz 格式的构建产物并切换
+func UploadSSRBundle(ctx *gin.Context, req ReqUploadSSRBundle) (*pkg.BundleInfo, error) {
+	if req.File == nil {
+		return nil, errors.New("file is required")
+	}
+
+	f, err := req.File.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := pkg.LoadBundleArchive(ctx.Request.Context(), req.App, req.File.Filename, f)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// RollbackSSRBundle 回滚到上一个 SSR 前端版本
+func RollbackSSRBundle(ctx *gin.Context, req ReqSSRBundle) (*pkg.BundleInfo, error) {
+	info, err := pkg.RollbackBundle(ctx.Request.Context(), req.App)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SSRBreaker 返回 SSR 渲染熔断器的状态
+func SSRBreaker(ctx *gin.Context, req ReqSSRBundle) (*pkg.BreakerStatus, error) {
+	status, err := pkg.Breaker(req.App)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SSRDiagnostics 返回 SSR 渲染器的诊断信息：isolate 池与堆、最近的渲染及失败记录、bundle 哈希
+func SSRDiagnostics(ctx *gin.Context, req ReqSSRBundle) (*pkg.Diagnostics, error) {
+	d, err := pkg.Diagnose(req.App)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/daodao97/xgo/xredis"
 	"github.com/daodao97/xgo/xrequest"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var Version string
@@ -40,14 +41,16 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "prerender" {
+		if err := prerender(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	app := xapp.NewApp().
-		AddStartup(
-			conf.Init,
-			func() error {
-				return xredis.Inits(conf.Get().Redis)
-			},
-			dao.Init,
-		).
+		AddStartup(startups()...).
 		AddServer(xapp.NewGinHttpServer(xapp.Args.Bind, h))
 
 	if os.Getenv("CRON_ENABLE") == "true" {
@@ -59,6 +62,16 @@ func main() {
 	}
 }
 
+func startups() []xapp.Startup {
+	return []xapp.Startup{
+		conf.Init,
+		func() error {
+			return xredis.Inits(conf.Get().Redis)
+		},
+		dao.Init,
+	}
+}
+
 func h() *gin.Engine {
 	r := xapp.NewGin(xapp.WithPrintReqeustLog(false))
 	defer func() {
@@ -67,7 +80,12 @@ func h() *gin.Engine {
 			xapp.WithInfo("team-gpt", Version, ""),
 			xapp.WithBearerAuth(),
 		)
+		// 预热渲染会经 fetch() 访问路由，必须在所有路由注册完之后
+		pkg.Prewarm()
 	}()
+	if os.Getenv("METRICS_ENABLE") == "true" {
+		r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	}
 	vueSsr(r)
 	api.SetupRouter(r)
 	admin.SetupRouter(r)
@@ -76,19 +94,24 @@ func h() *gin.Engine {
 }
 
 func vueSsr(r *gin.Engine) {
-	fsyFrontend, _ := fs.Sub(webssr.FrontendDist, "dist/client")
-	fsyServer, _ := fs.Sub(webssr.ServerDist, "dist/server")
-
 	pkg.RunBlocking(
 		r,
-		pkg.FrontendBuild{
-			FrontendDist: fsyFrontend,
-			ServerDist:   fsyServer,
-		},
+		frontendBuild(),
 		registerSSRFetchRoutes(r),
+		pkg.WithRouteLabel(page.RoutePattern),
 	)
 }
 
+func frontendBuild() pkg.FrontendBuild {
+	fsyFrontend, _ := fs.Sub(webssr.FrontendDist, "dist/client")
+	fsyServer, _ := fs.Sub(webssr.ServerDist, "dist/server")
+
+	return pkg.FrontendBuild{
+		FrontendDist: fsyFrontend,
+		ServerDist:   fsyServer,
+	}
+}
+
 const ssrFetchPrefix = pkg.DefaultSSRFetchPrefix
 
 func registerSSRFetchRoutes(r *gin.Engine) pkg.BackendDataFetcher {
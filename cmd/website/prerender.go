@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"slices"
+	"strings"
+
+	"vitego/api"
+	"vitego/api/page"
+	"vitego/pkg"
+	"vitego/pkg/locales"
+
+	"github.com/daodao97/xgo/xapp"
+)
+
+// prerender implements `website prerender`: it renders the SSR routes that
+// can be enumerated, plus -paths, and writes them for SSR_PRERENDER_DIR.
+func prerender(args []string) error {
+	flags := flag.NewFlagSet("prerender", flag.ContinueOnError)
+	out := flags.String("out", "dist/prerendered", "directory the pages are written to")
+	paths := flags.String("paths", "", "comma-separated paths to render besides the SSR routes; :locale is expanded, e.g. /:locale/hi/world")
+	localeList := flags.String("locales", strings.Join(locales.Supported, ","), "comma-separated locales :locale is expanded with")
+	origin := flags.String("origin", os.Getenv("SITE_ORIGIN"), "origin the pages are served from, e.g. https://example.com")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	for _, startup := range startups() {
+		if err := startup(); err != nil {
+			return err
+		}
+	}
+
+	r := xapp.NewGin(xapp.WithPrintReqeustLog(false))
+	api.SetupRouter(r)
+	fetcher := registerSSRFetchRoutes(r)
+
+	localized := splitList(*localeList)
+	targets := page.PrerenderPaths(localized)
+	for _, p := range splitList(*paths) {
+		if !strings.Contains(p, ":locale") {
+			targets = append(targets, p)
+			continue
+		}
+		for _, locale := range localized {
+			targets = append(targets, strings.ReplaceAll(p, ":locale", locale))
+		}
+	}
+	slices.Sort(targets)
+
+	return pkg.Prerender(context.Background(), r, frontendBuild(), fetcher, pkg.PrerenderOptions{
+		Paths:  slices.Compact(targets),
+		OutDir: *out,
+		Origin: *origin,
+	}, pkg.WithRouteLabel(page.RoutePattern))
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultAppName names the app RunBlocking mounts, and the app the bundle
+// functions use when given no name.
+const DefaultAppName = "default"
+
+// publicPathKey holds the request path before the app prefix was stripped.
+const publicPathKey = "ssr.publicPath"
+
+// App is an SSR app mounted by RunApps. Each app has its own renderer pool,
+// render limit, assets and page cache.
+type App struct {
+	// Name identifies the app in logs and the bundle API.
+	Name string
+	// Host selects the app by Host header, without the port; empty matches
+	// every host.
+	Host string
+	// Prefix selects the app by path prefix, such as /app. The app sees
+	// paths without it and serves its assets under Prefix/assets, so it
+	// must be built with Vite's base set to Prefix/.
+	Prefix string
+
+	Build   FrontendBuild
+	Fetcher BackendDataFetcher
+	Options []RunOption
+
+	// DevServerURL is the Vite dev server requests are proxied to in dev
+	// mode; it defaults to DEV_SERVER_URL.
+	DevServerURL string
+}
+
+// ssrApps holds the running apps by name.
+var ssrApps sync.Map
+
+var errNoSSRApp = errors.New("no SSR app is running")
+
+func lookupApp(name string) (*ssrApp, error) {
+	if name == "" {
+		name = DefaultAppName
+	}
+	if app, ok := ssrApps.Load(name); ok {
+		return app.(*ssrApp), nil
+	}
+	if name == DefaultAppName {
+		return nil, errNoSSRApp
+	}
+	return nil, fmt.Errorf("no SSR app named %q", name)
+}
+
+// mount is an app as routed by RunApps: either rendered in-process or, in
+// dev mode, proxied to its Vite dev server.
+type mount struct {
+	name   string
+	host   string
+	prefix string
+
+	app   *ssrApp
+	proxy *httputil.ReverseProxy
+}
+
+// RunApps mounts apps on router. A request goes to the app whose Host
+// matches, then to the one with the longest matching Prefix; requests no
+// app matches get a 404. RunApps claims router.NoRoute, which also serves
+// the requests the apps make to themselves.
+func RunApps(router *gin.Engine, apps ...App) {
+	devMode := isDevMode()
+	names := map[string]bool{}
+	mounts := make([]*mount, 0, len(apps))
+
+	for _, spec := range apps {
+		if spec.Name == "" && len(apps) == 1 {
+			spec.Name = DefaultAppName
+		}
+		if spec.Name == "" || names[spec.Name] {
+			log.Fatalf("ssr apps need unique names, got %q", spec.Name)
+		}
+		names[spec.Name] = true
+
+		m := &mount{
+			name:   spec.Name,
+			host:   strings.ToLower(spec.Host),
+			prefix: strings.TrimSuffix(spec.Prefix, "/"),
+		}
+		if m.prefix != "" && !strings.HasPrefix(m.prefix, "/") {
+			log.Fatalf("ssr app %s: prefix %q must start with /", spec.Name, spec.Prefix)
+		}
+
+		if devMode {
+			target := spec.DevServerURL
+			if target == "" {
+				target = devServerURL()
+			}
+			m.proxy = newDevProxy(target)
+			log.Printf("Development mode enabled. Proxying app %s to %s", spec.Name, target)
+		} else {
+			m.app = startApp(router, spec, m.prefix)
+			ssrApps.Store(spec.Name, m.app)
+		}
+		mounts = append(mounts, m)
+	}
+
+	// Host-specific apps first, then longer prefixes.
+	sort.SliceStable(mounts, func(i, j int) bool {
+		if (mounts[i].host != "") != (mounts[j].host != "") {
+			return mounts[i].host != ""
+		}
+		return len(mounts[i].prefix) > len(mounts[j].prefix)
+	})
+
+	router.NoRoute(func(c *gin.Context) {
+		if runLoopback(c) {
+			return
+		}
+		// fetch() from inside a render must never trigger another render.
+		if strings.HasPrefix(c.Request.URL.Path, DefaultSSRFetchPrefix) || c.GetHeader(renderer.FetchHeader) != "" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		m, rest := matchMount(mounts, c.Request)
+		if m == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if m.proxy != nil {
+			m.proxy.ServeHTTP(c.Writer, c.Request)
+			return
+		}
+
+		stripPrefix(c, rest)
+		if strings.HasPrefix(rest, "/assets/") {
+			m.app.serveAsset(c, strings.TrimPrefix(rest, "/"))
+			return
+		}
+		m.app.handle(c)
+	})
+}
+
+// stripPrefix makes rest the path of c's request, keeping the path it was
+// requested with for publicPath.
+func stripPrefix(c *gin.Context, rest string) {
+	c.Set(publicPathKey, c.Request.URL.Path)
+	if rest != c.Request.URL.Path {
+		r := *c.Request
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r.URL = &u
+		c.Request = &r
+	}
+}
+
+// Prewarm renders "/" of every app started by RunApps in the background, so
+// the first request does not pay for compiling server.js. A render may
+// fetch() through the router, so call Prewarm once every route is
+// registered.
+func Prewarm() {
+	ssrApps.Range(func(_, app any) bool {
+		prewarmRenderer(app.(*ssrApp).bundle.Load().ssr)
+		return true
+	})
+}
+
+// startApp loads spec and applies its options.
+func startApp(router *gin.Engine, spec App, prefix string) *ssrApp {
+	opts := newRunOptions(spec.Options)
+	app, err := newSSRApp(router, spec.Build, spec.Fetcher, opts)
+	if err != nil {
+		log.Fatalf("ssr app %s: %v", spec.Name, err)
+	}
+	app.name = spec.Name
+	app.prefix = prefix
+
+	breakerOpts := breakerFromEnv()
+	if opts.breaker != nil {
+		breakerOpts = *opts.breaker
+	}
+	app.breaker = newBreaker(spec.Name, breakerOpts)
+
+	app.cache = opts.cache
+	if app.cache == nil {
+		app.cache = pageCacheFromEnv()
+	}
+	if app.cache != nil {
+		app.cache.router = router
+		registerPageCache(app.cache)
+	}
+
+	// SSR_PRERENDER_DIR holds the pages of a single app.
+	app.prerendered = opts.prerendered
+	if app.prerendered == nil && spec.Name == DefaultAppName {
+		app.prerendered = prerenderedFromEnv()
+	}
+	return app
+}
+
+// matchMount returns the mount for r and the path within it.
+func matchMount(mounts []*mount, r *http.Request) (*mount, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	p := r.URL.Path
+	for _, m := range mounts {
+		if m.host != "" && m.host != host {
+			continue
+		}
+		if m.prefix == "" {
+			return m, p
+		}
+		if rest, ok := strings.CutPrefix(p, m.prefix); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			if rest == "" {
+				rest = "/"
+			}
+			return m, rest
+		}
+	}
+	return nil, ""
+}
+
+// publicPath returns the path c was requested with, before the app prefix
+// was stripped.
+func publicPath(c *gin.Context) string {
+	if p := c.GetString(publicPathKey); p != "" {
+		return p
+	}
+	return c.Request.URL.Path
+}
+
+// publicLocation adds the app prefix to a redirect within the app.
+func (a *ssrApp) publicLocation(location string) string {
+	if a.prefix == "" || !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+		return location
+	}
+	return a.prefix + location
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFetchNeverRenders(t *testing.T) {
+	// /api/page and the SSR fetch prefix have no route, so they reach the
+	// NoRoute handler that renders pages.
+	server := fstest.MapFS{"server.js": {Data: []byte(`globalThis.ssrRender = async (p) => {
+  if (p !== "/") return "page " + p
+  const codes = []
+  for (const url of ["/api/page", "/__ssr_fetch/page"]) codes.push((await fetch(url)).status)
+  return codes.join(",")
+}`)}}
+	router := gin.New()
+	RunApps(router, App{Name: "fetch-loop", Build: FrontendBuild{
+		FrontendDist: fstest.MapFS{"index.html": {Data: []byte(`<html><head></head><body><!--app-html--></body></html>`)}},
+		ServerDist:   server,
+	}})
+	t.Cleanup(func() { ssrApps.Delete("fetch-loop") })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("page status = %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<body>404,404</body>") {
+		t.Fatalf("fetches from the render were not refused:\n%s", body)
+	}
+}
+
+func TestMatchMount(t *testing.T) {
+	// Sorted as RunApps sorts them: host-specific apps first, then longer
+	// prefixes.
+	mounts := []*mount{
+		{name: "admin-host", host: "admin.example.com"},
+		{name: "docs", prefix: "/docs/v2"},
+		{name: "dev", prefix: "/dev", proxy: &httputil.ReverseProxy{}},
+		{name: "app", prefix: "/app"},
+		{name: "site"},
+	}
+
+	for _, tt := range []struct {
+		host, path string
+		want, rest string
+	}{
+		{"admin.example.com", "/app/x", "admin-host", "/app/x"},
+		{"ADMIN.example.com:8443", "/", "admin-host", "/"},
+		{"example.com", "/app", "app", "/"},
+		{"example.com", "/app/", "app", "/"},
+		{"example.com", "/app/users/1", "app", "/users/1"},
+		{"example.com", "/apple", "site", "/apple"},
+		{"example.com", "/docs/v2/intro", "docs", "/intro"},
+		{"example.com", "/docs/v1/intro", "site", "/docs/v1/intro"},
+		{"example.com", "/dev/src/main.ts", "dev", "/src/main.ts"},
+		{"example.com", "//app/x", "site", "//app/x"},
+		{"example.com", "/", "site", "/"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host, r.URL.Path = tt.host, tt.path
+		m, rest := matchMount(mounts, r)
+		if m == nil || m.name != tt.want || rest != tt.rest {
+			name := "<nil>"
+			if m != nil {
+				name = m.name
+			}
+			t.Errorf("matchMount(%s%s) = %s %q, want %s %q", tt.host, tt.path, name, rest, tt.want, tt.rest)
+		}
+	}
+
+	if m, _ := matchMount(mounts[:4], httptest.NewRequest(http.MethodGet, "/other", nil)); m != nil {
+		t.Errorf("matchMount(/other) = %s without a catch-all app, want none", m.name)
+	}
+}
+
+func TestPublicLocation(t *testing.T) {
+	prefixed, root := &ssrApp{prefix: "/app"}, &ssrApp{}
+	for _, tt := range []struct {
+		app      *ssrApp
+		location string
+		want     string
+	}{
+		{prefixed, "/login", "/app/login"},
+		{prefixed, "/", "/app/"},
+		{prefixed, "/login?next=%2Fme", "/app/login?next=%2Fme"},
+		{prefixed, "//cdn.example.com/x", "//cdn.example.com/x"},
+		{prefixed, "https://example.com/login", "https://example.com/login"},
+		{prefixed, "login", "login"},
+		{prefixed, "", ""},
+		{root, "/login", "/login"},
+	} {
+		if got := tt.app.publicLocation(tt.location); got != tt.want {
+			t.Errorf("publicLocation(%q) with prefix %q = %q, want %q", tt.location, tt.app.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+	defaultBreakerProbes   = 3
+)
+
+// errRenderShed marks renders turned away to protect the renderer. Their
+// pages fall back to client-side rendering without an error being logged.
+var errRenderShed = errors.New("render shed")
+
+var (
+	errQueueBudget = fmt.Errorf("%w: queue wait exceeded the budget", errRenderShed)
+	errBreakerOpen = fmt.Errorf("%w: circuit breaker is open", errRenderShed)
+)
+
+// BreakerOptions configures the circuit breaker in front of an app's
+// renderer.
+type BreakerOptions struct {
+	// Failures is how many renders in a row must fail or time out to open
+	// the breaker; 0 disables it.
+	Failures int
+	// Cooldown is how long an open breaker serves client-side rendered
+	// pages only, before it lets probe renders through. Zero selects 30s.
+	Cooldown time.Duration
+	// Probes is how many probe renders in a row must succeed to close the
+	// breaker. Probes run one at a time. Zero selects 3.
+	Probes int
+}
+
+// WithBreaker configures the circuit breaker instead of SSR_BREAKER_*
+// variables; a zero Failures disables it.
+func WithBreaker(opts BreakerOptions) RunOption {
+	return func(o *runOptions) {
+		o.breaker = &opts
+	}
+}
+
+// BreakerStatus reports the circuit breaker of an app.
+type BreakerStatus struct {
+	State string `json:"state"`
+	// Failures counts the renders that failed in a row while closed.
+	Failures int `json:"failures"`
+	// Probes counts the probe renders that succeeded while half open.
+	Probes    int        `json:"probes"`
+	OpenedAt  *time.Time `json:"openedAt,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// breaker switches an app to client-side rendering after repeated render
+// failures. A nil breaker admits every render.
+type breaker struct {
+	app  string
+	opts BreakerOptions
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	successes int
+	probing   bool
+	openedAt  time.Time
+	lastError string
+}
+
+func newBreaker(app string, opts BreakerOptions) *breaker {
+	if opts.Failures <= 0 {
+		return nil
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultBreakerCooldown
+	}
+	if opts.Probes <= 0 {
+		opts.Probes = defaultBreakerProbes
+	}
+	b := &breaker{app: app, opts: opts, state: BreakerClosed}
+	b.report()
+	return b
+}
+
+// admit reports whether a render may run. When it may, done must be called
+// with the render's error.
+func (b *breaker) admit() (done func(error), ok bool) {
+	if b == nil {
+		return func(error) {}, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.opts.Cooldown {
+			return nil, false
+		}
+		b.transition(BreakerHalfOpen, "cooldown over")
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return nil, false
+		}
+		b.probing = true
+		return b.probeDone, true
+	default:
+		return b.renderDone, true
+	}
+}
+
+// breakerFailure reports whether err counts against the renderer. Only
+// renders that started do: shed renders, including those whose deadline
+// passed while they waited for a slot, and requests the client gave up on
+// do not.
+func breakerFailure(err error) bool {
+	return err != nil && !errors.Is(err, errRenderShed) && !errors.Is(err, context.Canceled)
+}
+
+func (b *breaker) renderDone(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		return
+	}
+
+	if !breakerFailure(err) {
+		if err == nil {
+			b.failures = 0
+		}
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.failures >= b.opts.Failures {
+		b.open(fmt.Sprintf("%d renders failed in a row", b.failures))
+	}
+}
+
+func (b *breaker) probeDone(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if b.state != BreakerHalfOpen {
+		return
+	}
+
+	switch {
+	case breakerFailure(err):
+		b.lastError = err.Error()
+		b.open("probe render failed")
+	case err == nil:
+		b.successes++
+		if b.successes >= b.opts.Probes {
+			b.transition(BreakerClosed, fmt.Sprintf("%d probe renders succeeded", b.successes))
+		}
+	}
+}
+
+// reset closes the breaker, e.g. after a new bundle was swapped in.
+func (b *breaker) reset(reason string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		b.transition(BreakerClosed, reason)
+	}
+	b.failures = 0
+}
+
+func (b *breaker) open(reason string) {
+	b.openedAt = time.Now()
+	b.transition(BreakerOpen, reason)
+}
+
+func (b *breaker) transition(state, reason string) {
+	log.Printf("ssr breaker app=%s %s -> %s reason=%q last_error=%q", b.app, b.state, state, reason, b.lastError)
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	breakerTransitions.WithLabelValues(b.app, state).Inc()
+	b.report()
+}
+
+func (b *breaker) report() {
+	for _, state := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		v := 0.0
+		if state == b.state {
+			v = 1
+		}
+		breakerState.WithLabelValues(b.app, state).Set(v)
+	}
+}
+
+func (b *breaker) status() BreakerStatus {
+	if b == nil {
+		return BreakerStatus{State: BreakerClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		Probes:    b.successes,
+		LastError: b.lastError,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// Breaker reports the circuit breaker of the named app; "" names
+// DefaultAppName. Apps without a breaker report it closed.
+func Breaker(appName string) (BreakerStatus, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return BreakerStatus{}, err
+	}
+	return app.breaker.status(), nil
+}
+
+// breakerFromEnv reads SSR_BREAKER_FAILURES (0 disables the breaker),
+// SSR_BREAKER_COOLDOWN and SSR_BREAKER_PROBES.
+func breakerFromEnv() BreakerOptions {
+	opts := BreakerOptions{
+		Failures: defaultBreakerFailures,
+		Cooldown: defaultBreakerCooldown,
+		Probes:   defaultBreakerProbes,
+	}
+	if v, ok := envInt("SSR_BREAKER_FAILURES"); ok {
+		opts.Failures = v
+	}
+	if v, ok := envDuration("SSR_BREAKER_COOLDOWN"); ok {
+		opts.Cooldown = v
+	}
+	if v, ok := envInt("SSR_BREAKER_PROBES"); ok {
+		opts.Probes = v
+	}
+	return opts
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"vitego/pkg/renderer"
+)
+
+func TestNewBreakerDefaults(t *testing.T) {
+	if b := newBreaker("test", BreakerOptions{}); b != nil {
+		t.Fatal("a zero Failures did not disable the breaker")
+	}
+
+	b := newBreaker("test", BreakerOptions{Failures: 1})
+	if b.opts.Cooldown != defaultBreakerCooldown || b.opts.Probes != defaultBreakerProbes {
+		t.Fatalf("cooldown %v probes %d, want %v and %d",
+			b.opts.Cooldown, b.opts.Probes, defaultBreakerCooldown, defaultBreakerProbes)
+	}
+	if env := breakerFromEnv(); env.Cooldown != b.opts.Cooldown || env.Probes != b.opts.Probes {
+		t.Fatalf("WithBreaker defaults %+v differ from the environment defaults %+v", b.opts, env)
+	}
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	b := newBreaker("test", BreakerOptions{Failures: 2, Cooldown: 10 * time.Millisecond, Probes: 2})
+	errRender := errors.New("render failed")
+
+	render := func(err error) bool {
+		t.Helper()
+		done, ok := b.admit()
+		if ok {
+			done(err)
+		}
+		return ok
+	}
+
+	render(errRender)
+	render(nil)
+	render(errRender)
+	if state := b.status().State; state != BreakerClosed {
+		t.Fatalf("state %s after failures that were not in a row, want %s", state, BreakerClosed)
+	}
+	render(errRender)
+	if state := b.status().State; state != BreakerOpen {
+		t.Fatalf("state %s after %d failures in a row, want %s", state, 2, BreakerOpen)
+	}
+	if render(nil) {
+		t.Fatal("an open breaker admitted a render before the cooldown")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	done, ok := b.admit()
+	if !ok {
+		t.Fatal("no probe was admitted after the cooldown")
+	}
+	if _, ok := b.admit(); ok {
+		t.Fatal("a second probe was admitted while one is running")
+	}
+	done(nil)
+	if state := b.status().State; state != BreakerHalfOpen {
+		t.Fatalf("state %s after one of two probes, want %s", state, BreakerHalfOpen)
+	}
+	render(nil)
+	if state := b.status().State; state != BreakerClosed {
+		t.Fatalf("state %s after the probes succeeded, want %s", state, BreakerClosed)
+	}
+}
+
+func TestBreakerIgnoresShedRenders(t *testing.T) {
+	b := newBreaker("test", BreakerOptions{Failures: 1})
+	done, _ := b.admit()
+	done(errRenderShed)
+	if state := b.status().State; state != BreakerClosed {
+		t.Fatal("a shed render opened the breaker")
+	}
+}
+
+// blockingEngine is an Engine whose renders run until their context ends.
+type blockingEngine struct {
+	renderer.Engine
+}
+
+func (blockingEngine) Render(ctx context.Context, _ string, _ map[string]any) (renderer.Result, error) {
+	<-ctx.Done()
+	return renderer.Result{}, ctx.Err()
+}
+
+func TestBreakerCountsStartedRendersOnly(t *testing.T) {
+	render := func(sem chan struct{}) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := renderWithDeadline(ctx, blockingEngine{}, "/", "/", nil, sem, 0, nil)
+		return err
+	}
+
+	full := make(chan struct{}, 1)
+	full <- struct{}{}
+	err := render(full)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errRenderShed) {
+		t.Fatalf("render timing out in the queue = %v, want a shed deadline error", err)
+	}
+	if breakerFailure(err) {
+		t.Fatal("a render that timed out waiting for a slot counts as a failure")
+	}
+
+	if err := render(make(chan struct{}, 1)); !breakerFailure(err) {
+		t.Fatalf("a render that timed out running = %v, want a failure", err)
+	}
+}
@@ -0,0 +1,491 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bundleClientDir and bundleServerDir mirror the Vite output: a loaded
+	// directory holds client/index.html, client/assets and server/server.js.
+	bundleClientDir = "client"
+	bundleServerDir = "server"
+
+	defaultBundleRoot = "bundles"
+	defaultSmokePath  = "/"
+
+	maxArchiveSize    = 256 << 20
+	maxArchiveEntries = 10000
+)
+
+// BundleInfo describes a loaded index.html and server bundle.
+type BundleInfo struct {
+	// Version fingerprints index.html and the server bundle.
+	Version  string    `json:"version"`
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+// BundleStatus reports the bundle being served and the one a rollback
+// returns to.
+type BundleStatus struct {
+	Current  *BundleInfo `json:"current"`
+	Previous *BundleInfo `json:"previous,omitempty"`
+}
+
+// ssrBundle is a frontend build with its renderer. Renders hold a reference
+// so a swapped-out bundle is closed only after they finish.
+type ssrBundle struct {
+	info  BundleInfo
+	build FrontendBuild
+	ssr   renderer.Engine
+	doc   *document
+	// uploadDir is the directory LoadBundleArchive extracted the build to,
+	// or empty for builds it does not own.
+	uploadDir string
+
+	mu       sync.Mutex
+	inflight int
+	retired  bool
+	// dropped is set once no rollback can return to the bundle, so its
+	// upload directory goes when its renderer is closed.
+	dropped bool
+}
+
+func (b *ssrBundle) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.retired {
+		return false
+	}
+	b.inflight++
+	return true
+}
+
+func (b *ssrBundle) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight--
+	if b.retired && b.inflight == 0 {
+		b.close()
+	}
+}
+
+// retire closes the renderer once the renders using it are done.
+func (b *ssrBundle) retire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.retired {
+		return
+	}
+	b.retired = true
+	if b.inflight == 0 {
+		b.close()
+	}
+}
+
+// drop marks a retired bundle that was pushed out of the rollback slot; its
+// upload directory is removed once the renders using it are done.
+func (b *ssrBundle) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropped = true
+	if b.retired && b.inflight == 0 {
+		b.removeUpload()
+	}
+}
+
+// close closes the renderer, and removes the upload directory of a dropped
+// bundle. The caller holds mu.
+func (b *ssrBundle) close() {
+	b.ssr.Close()
+	if b.dropped {
+		b.removeUpload()
+	}
+}
+
+func (b *ssrBundle) removeUpload() {
+	if b.uploadDir == "" {
+		return
+	}
+	if err := os.RemoveAll(b.uploadDir); err != nil {
+		log.Printf("ssr bundle upload cleanup failed dir=%s err=%v", b.uploadDir, err)
+	}
+	b.uploadDir = ""
+}
+
+// LoadBundle validates the build in dir with a smoke render and swaps it in
+// for the named app; "" names DefaultAppName. dir holds client/index.html,
+// client/assets and server/server.js; it is read lazily and must not change
+// while the bundle is loaded.
+func LoadBundle(ctx context.Context, appName string, dir string) (BundleInfo, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	return app.swap(ctx, dirBuild(dir), dir, "")
+}
+
+// LoadBundleArchive extracts a .zip or .tar.gz of the build directory under
+// the bundle root (SSR_BUNDLE_DIR) and loads it like LoadBundle. The archive
+// may hold the directory itself or a single directory wrapping it, such as
+// dist/. The extracted directory is removed once the bundle is neither the
+// current nor the previous one.
+func LoadBundleArchive(ctx context.Context, appName string, name string, r io.Reader) (BundleInfo, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxArchiveSize+1))
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	if len(data) > maxArchiveSize {
+		return BundleInfo{}, fmt.Errorf("archive is larger than %d bytes", maxArchiveSize)
+	}
+
+	root := BundleRoot()
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return BundleInfo{}, err
+	}
+	dir, err := os.MkdirTemp(root, "upload-")
+	if err != nil {
+		return BundleInfo{}, err
+	}
+
+	switch lower := strings.ToLower(name); {
+	case strings.HasSuffix(lower, ".zip"):
+		err = extractZip(data, dir)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		err = extractTarGz(data, dir)
+	default:
+		err = fmt.Errorf("unsupported archive %q, want .zip or .tar.gz", name)
+	}
+	if err == nil {
+		source := bundleDirIn(dir)
+		var info BundleInfo
+		if info, err = app.swap(ctx, dirBuild(source), source, dir); err == nil {
+			return info, nil
+		}
+	}
+	os.RemoveAll(dir)
+	return BundleInfo{}, err
+}
+
+// RollbackBundle swaps the previous bundle back in, after validating it again.
+func RollbackBundle(ctx context.Context, appName string) (BundleInfo, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	return app.rollback(ctx)
+}
+
+// CurrentBundle reports the loaded bundles of the named app.
+func CurrentBundle(appName string) (BundleStatus, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return BundleStatus{}, err
+	}
+	return app.bundleStatus(), nil
+}
+
+// BundleRoot is where uploaded bundles are extracted and where the admin API
+// looks up directories to load, from SSR_BUNDLE_DIR.
+func BundleRoot() string {
+	if dir := strings.TrimSpace(os.Getenv("SSR_BUNDLE_DIR")); dir != "" {
+		return dir
+	}
+	return defaultBundleRoot
+}
+
+func dirBuild(dir string) FrontendBuild {
+	return FrontendBuild{
+		FrontendDist: os.DirFS(filepath.Join(dir, bundleClientDir)),
+		ServerDist:   os.DirFS(filepath.Join(dir, bundleServerDir)),
+	}
+}
+
+// bundleDirIn returns dir, or the single directory inside it when the
+// archive wrapped the build in one.
+func bundleDirIn(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, bundleClientDir)); err == nil {
+		return dir
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return dir
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
+
+// loadBundle reads index.html and starts a renderer for build.
+func (a *ssrApp) loadBundle(build FrontendBuild, source string) (*ssrBundle, error) {
+	indexBytes, err := readFSFile(build.FrontendDist, "index.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index.html: %w", err)
+	}
+	doc, err := parseDocument(string(indexBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index.html: %w", err)
+	}
+
+	ssr, err := a.newEngine(build.ServerDist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server.js: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write(indexBytes)
+	io.WriteString(h, ssr.BundleHash())
+
+	return &ssrBundle{
+		info: BundleInfo{
+			Version:  hex.EncodeToString(h.Sum(nil))[:12],
+			Source:   source,
+			LoadedAt: time.Now(),
+		},
+		build: build,
+		ssr:   ssr,
+		doc:   doc,
+	}, nil
+}
+
+// acquireBundle returns the current bundle, referenced until release.
+func (a *ssrApp) acquireBundle() *ssrBundle {
+	for {
+		if b := a.bundle.Load(); b.acquire() {
+			return b
+		}
+	}
+}
+
+// swap installs build; uploadDir, when not empty, is the directory the
+// bundle owns and removes once it is no longer the current or previous one.
+func (a *ssrApp) swap(ctx context.Context, build FrontendBuild, source string, uploadDir string) (BundleInfo, error) {
+	a.swapMu.Lock()
+	defer a.swapMu.Unlock()
+
+	return a.install(ctx, build, source, uploadDir)
+}
+
+func (a *ssrApp) rollback(ctx context.Context) (BundleInfo, error) {
+	a.swapMu.Lock()
+	defer a.swapMu.Unlock()
+
+	previous := a.previous.Load()
+	if previous == nil {
+		return BundleInfo{}, errors.New("no previous bundle to roll back to")
+	}
+	return a.install(ctx, previous.build, previous.info.Source, previous.uploadDir)
+}
+
+// install loads build, smoke-renders it and makes it current; the bundle it
+// replaces becomes the rollback target, and the former rollback target is
+// dropped. The caller holds swapMu.
+func (a *ssrApp) install(ctx context.Context, build FrontendBuild, source string, uploadDir string) (BundleInfo, error) {
+	b, err := a.loadBundle(build, source)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	b.uploadDir = uploadDir
+	if err := a.smokeRender(ctx, b); err != nil {
+		b.retire()
+		return BundleInfo{}, fmt.Errorf("smoke render of bundle %s failed: %w", b.info.Version, err)
+	}
+
+	old := a.bundle.Swap(b)
+	old.retire()
+	if dropped := a.previous.Swap(old); dropped != nil && dropped.uploadDir != b.uploadDir {
+		// A rollback installs the previous build again, from its directory.
+		dropped.drop()
+	}
+	log.Printf("ssr bundle swapped app=%s version=%s source=%s previous=%s", a.name, b.info.Version, source, old.info.Version)
+	a.breaker.reset("bundle swapped")
+
+	if a.cache != nil {
+		if _, err := a.cache.store.PurgePrefix(ctx, a.prefix+"/"); err != nil {
+			log.Printf("ssr cache purge after bundle swap failed: %v", err)
+		}
+	}
+	return b.info, nil
+}
+
+// smokeRenderKey marks the smoke render of a new bundle, which bypasses the
+// circuit breaker and the queue-wait budget.
+const smokeRenderKey = "ssr.smoke"
+
+// smokeRender renders SSR_SMOKE_PATH with b the way a request would and
+// fails on a server error or a CSR fallback.
+func (a *ssrApp) smokeRender(ctx context.Context, b *ssrBundle) error {
+	smokePath := strings.TrimSpace(os.Getenv("SSR_SMOKE_PATH"))
+	if smokePath == "" {
+		smokePath = defaultSmokePath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.prefix+smokePath, http.NoBody)
+	if err != nil {
+		return err
+	}
+	fellBack := false
+	b.acquire()
+	w, err := serveLoopback(a.router, req, func(c *gin.Context) {
+		stripPrefix(c, smokePath)
+		c.Set(smokeRenderKey, true)
+		a.serveWith(c, b)
+		fellBack = c.GetBool(noCacheKey)
+	})
+	b.release()
+
+	switch {
+	case err != nil:
+		return err
+	case fellBack:
+		return errors.New("the page fell back to client-side rendering")
+	case w.Status() >= http.StatusInternalServerError:
+		return fmt.Errorf("status %d", w.Status())
+	}
+	return nil
+}
+
+func (a *ssrApp) bundleStatus() BundleStatus {
+	current := a.bundle.Load().info
+	status := BundleStatus{Current: &current}
+	if previous := a.previous.Load(); previous != nil {
+		info := previous.info
+		status.Previous = &info
+	}
+	return status
+}
+
+// serveAsset serves name, a path below assets/, from the current bundle,
+// then the previous one, so pages loaded before a swap can still fetch their
+// chunks.
+func (a *ssrApp) serveAsset(c *gin.Context, name string) {
+	if !fs.ValidPath(name) || path.Clean(name) != name {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	builds := []FrontendBuild{a.bundle.Load().build}
+	if previous := a.previous.Load(); previous != nil {
+		builds = append(builds, previous.build)
+	}
+
+	for _, build := range builds {
+		if info, err := fs.Stat(build.FrontendDist, name); err == nil && !info.IsDir() {
+			c.FileFromFS(name, http.FS(build.FrontendDist))
+			return
+		}
+	}
+	c.Status(http.StatusNotFound)
+}
+
+func extractZip(data []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > maxArchiveEntries {
+		return fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+	}
+
+	var total int64
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		n, err := writeArchiveFile(dir, f.Name, rc, maxArchiveSize-total)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	return nil
+}
+
+func extractTarGz(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	var total int64
+	for entries := 0; ; entries++ {
+		if entries > maxArchiveEntries {
+			return fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		n, err := writeArchiveFile(dir, hdr.Name, tr, maxArchiveSize-total)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+}
+
+// writeArchiveFile writes one regular archive entry below dir, rejecting
+// names that would escape it and output beyond limit bytes.
+func writeArchiveFile(dir, name string, r io.Reader, limit int64) (int64, error) {
+	name = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+	if !fs.ValidPath(name) || name == "." {
+		return 0, fmt.Errorf("invalid archive entry %q", name)
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(r, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("archive expands to more than %d bytes", maxArchiveSize)
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vitego/pkg/renderer"
+)
+
+// closeCountingEngine is an Engine that only counts Close calls.
+type closeCountingEngine struct {
+	renderer.Engine
+	closed int
+}
+
+func (e *closeCountingEngine) Close() { e.closed++ }
+
+func uploadedBundle(t *testing.T) (*ssrBundle, *closeCountingEngine) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "upload-1")
+	if err := os.MkdirAll(filepath.Join(dir, bundleClientDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	engine := &closeCountingEngine{}
+	return &ssrBundle{ssr: engine, uploadDir: dir}, engine
+}
+
+func dirExists(dir string) bool {
+	_, err := os.Stat(dir)
+	return err == nil
+}
+
+func TestBundleDropRemovesUpload(t *testing.T) {
+	b, engine := uploadedBundle(t)
+	dir := b.uploadDir
+
+	b.retire()
+	if engine.closed != 1 {
+		t.Fatalf("renderer closed %d times on retire, want 1", engine.closed)
+	}
+	if !dirExists(dir) {
+		t.Fatal("retire removed the upload directory of the rollback target")
+	}
+
+	b.drop()
+	if dirExists(dir) {
+		t.Fatal("drop left the upload directory")
+	}
+}
+
+func TestBundleDropWaitsForRenders(t *testing.T) {
+	b, engine := uploadedBundle(t)
+	dir := b.uploadDir
+
+	if !b.acquire() {
+		t.Fatal("acquire failed on a live bundle")
+	}
+	b.retire()
+	b.drop()
+	if engine.closed != 0 || !dirExists(dir) {
+		t.Fatal("the bundle was closed or removed while a render held it")
+	}
+	if b.acquire() {
+		t.Fatal("acquire succeeded on a retired bundle")
+	}
+
+	b.release()
+	if engine.closed != 1 {
+		t.Fatalf("renderer closed %d times after the last render, want 1", engine.closed)
+	}
+	if dirExists(dir) {
+		t.Fatal("the upload directory was left after the last render")
+	}
+}
+
+func TestBundleWithoutUploadKeepsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	b := &ssrBundle{ssr: &closeCountingEngine{}, build: dirBuild(dir)}
+
+	b.retire()
+	b.drop()
+	if !dirExists(dir) {
+		t.Fatal("dropping a loaded directory removed it")
+	}
+}
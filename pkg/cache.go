@@ -0,0 +1,394 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vitego/pkg/pagecache"
+
+	"github.com/daodao97/xgo/xredis"
+	"github.com/gin-gonic/gin"
+)
+
+// PageCacheHeader reports how a page was served: HIT, STALE, MISS or BYPASS.
+const PageCacheHeader = "X-SSR-Cache"
+
+const (
+	defaultPageCacheTTL   = time.Minute
+	defaultPageCacheStale = 5 * time.Minute
+)
+
+// noCacheKey marks a response that must not be stored, such as the CSR
+// fallback page.
+const noCacheKey = "ssr.nocache"
+
+// requestVaryKey holds what a request's page varies by besides its path,
+// query, origin and locale; see pageCache.vary.
+const requestVaryKey = "ssr.vary"
+
+// PageCacheOptions configures the rendered-page cache.
+type PageCacheOptions struct {
+	// TTL is how long a page is served without rendering it again.
+	TTL time.Duration
+	// Stale is how long after TTL a page is still served while it is
+	// rendered again in the background.
+	Stale time.Duration
+	// Vary lists request headers pages differ by, such as Sec-CH-UA-Mobile
+	// for a page with a mobile layout. Pages are cached per value and
+	// served with a Vary header naming them. Keep it to headers with few
+	// values: Accept-Language, for one, is rarely the same twice.
+	Vary []string
+}
+
+// WithPageCache puts store in front of the renderer. Without it the cache is
+// configured from SSR_CACHE and friends.
+func WithPageCache(store pagecache.Store, opts PageCacheOptions) RunOption {
+	return func(o *runOptions) {
+		o.cache = newPageCache(store, opts)
+	}
+}
+
+// cacheableStatus lists the statuses whose pages are stored.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                true,
+	http.StatusMovedPermanently:  true,
+	http.StatusPermanentRedirect: true,
+	http.StatusNotFound:          true,
+	http.StatusGone:              true,
+}
+
+// pageCache serves rendered pages from a Store. Stale pages are served while
+// a single background render per key refreshes them.
+type pageCache struct {
+	store pagecache.Store
+	ttl   time.Duration
+	stale time.Duration
+	// varyHeaders are the canonical Vary names and varyValue the Vary
+	// response header, empty when pages vary by no header.
+	varyHeaders []string
+	varyValue   string
+
+	// router serves the background renders of stale pages.
+	router http.Handler
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+func newPageCache(store pagecache.Store, opts PageCacheOptions) *pageCache {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultPageCacheTTL
+	}
+	if opts.Stale < 0 {
+		opts.Stale = 0
+	}
+	var vary []string
+	for _, name := range opts.Vary {
+		if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !slices.Contains(vary, name) {
+			vary = append(vary, name)
+		}
+	}
+	return &pageCache{
+		store:        store,
+		ttl:          opts.TTL,
+		stale:        opts.Stale,
+		varyHeaders:  vary,
+		varyValue:    strings.Join(vary, ", "),
+		revalidating: map[string]bool{},
+	}
+}
+
+// vary encodes the Vary headers of r and the cookies server.js is allowed
+// to see, so pages that differ by them are cached apart.
+func (pc *pageCache) vary(r *http.Request, cookies map[string]string) string {
+	values := url.Values{}
+	for _, name := range pc.varyHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			values.Set("h:"+name, strings.Join(v, ","))
+		}
+	}
+	for name, v := range cookies {
+		values.Set("c:"+name, v)
+	}
+	return values.Encode()
+}
+
+// pageCaches holds the caches of running apps for the purge functions.
+var pageCaches = struct {
+	sync.Mutex
+	list []*pageCache
+}{}
+
+func registerPageCache(pc *pageCache) {
+	pageCaches.Lock()
+	pageCaches.list = append(pageCaches.list, pc)
+	pageCaches.Unlock()
+}
+
+// PurgePageCache removes every cached variant of path and returns how many
+// entries were removed. With the memory backend only this process is purged.
+func PurgePageCache(ctx context.Context, path string) (int, error) {
+	return purgePageCaches(func(s pagecache.Store) (int, error) {
+		return s.Purge(ctx, path)
+	})
+}
+
+// PurgePageCachePrefix removes every cached page whose path starts with
+// prefix; "/" empties the cache.
+func PurgePageCachePrefix(ctx context.Context, prefix string) (int, error) {
+	return purgePageCaches(func(s pagecache.Store) (int, error) {
+		return s.PurgePrefix(ctx, prefix)
+	})
+}
+
+func purgePageCaches(purge func(pagecache.Store) (int, error)) (int, error) {
+	pageCaches.Lock()
+	caches := slices.Clone(pageCaches.list)
+	pageCaches.Unlock()
+
+	total := 0
+	for _, pc := range caches {
+		n, err := purge(pc.store)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// key returns the cache key for c, by the path it was requested with. Only
+// anonymous GET and HEAD requests are cached: pages rendered for a session
+// carry its token in __SSR_DATA__.
+func (pc *pageCache) key(c *gin.Context) (pagecache.Key, bool) {
+	r := c.Request
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return pagecache.Key{}, false
+	}
+	if sessionStateFromRequest(r) != nil {
+		return pagecache.Key{}, false
+	}
+
+	query := r.URL.RawQuery
+	if values, err := url.ParseQuery(query); err == nil {
+		query = values.Encode()
+	}
+	return pagecache.Key{
+		Path:   publicPath(c),
+		Query:  query,
+		Origin: requestOrigin(r),
+		Locale: localeFromPath(r.URL.Path),
+		Vary:   c.GetString(requestVaryKey),
+	}, true
+}
+
+// serve answers c from the cache, rendering through render on a miss.
+func (pc *pageCache) serve(c *gin.Context, render gin.HandlerFunc) {
+	if pc.varyValue != "" {
+		c.Writer.Header().Add("Vary", pc.varyValue)
+	}
+	key, ok := pc.key(c)
+	if !ok {
+		pageCacheRequests.WithLabelValues("bypass").Inc()
+		c.Header(PageCacheHeader, "BYPASS")
+		render(c)
+		return
+	}
+
+	entry, err := pc.store.Get(c.Request.Context(), key)
+	if err != nil {
+		log.Printf("ssr cache get failed path=%s err=%v", key.Path, err)
+	}
+
+	now := time.Now()
+	if entry != nil && entry.Fresh(now) {
+		pageCacheRequests.WithLabelValues("hit").Inc()
+		writeCachedPage(c, entry, "HIT")
+		return
+	}
+	if entry != nil && entry.Usable(now) {
+		pageCacheRequests.WithLabelValues("stale").Inc()
+		pc.revalidate(key, c.Request, render)
+		writeCachedPage(c, entry, "STALE")
+		return
+	}
+
+	pageCacheRequests.WithLabelValues("miss").Inc()
+	c.Header(PageCacheHeader, "MISS")
+	pc.renderAndStore(c, key, render)
+}
+
+// revalidate renders key again in the background unless that is already
+// under way. The request is detached from the client connection.
+func (pc *pageCache) revalidate(key pagecache.Key, r *http.Request, render gin.HandlerFunc) {
+	id := key.String()
+	pc.mu.Lock()
+	if pc.revalidating[id] {
+		pc.mu.Unlock()
+		return
+	}
+	pc.revalidating[id] = true
+	pc.mu.Unlock()
+
+	// The request is routed by the path it was requested with, and rendered
+	// with the path within its app like r.
+	rest := r.URL.Path
+	req := r.Clone(context.Background())
+	req.Method = http.MethodGet
+	req.URL.Path, req.URL.RawPath = key.Path, ""
+	go func() {
+		defer func() {
+			pc.mu.Lock()
+			delete(pc.revalidating, id)
+			pc.mu.Unlock()
+		}()
+
+		_, err := serveLoopback(pc.router, req, func(c *gin.Context) {
+			stripPrefix(c, rest)
+			pc.renderAndStore(c, key, render)
+		})
+		if err != nil {
+			log.Printf("ssr cache revalidation failed path=%s err=%v", key.Path, err)
+		}
+	}()
+}
+
+// renderAndStore renders through render while copying the response, and
+// stores it if it may be reused.
+func (pc *pageCache) renderAndStore(c *gin.Context, key pagecache.Key, render gin.HandlerFunc) {
+	before := c.Writer.Header().Clone()
+	w := &captureWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	render(c)
+	c.Writer = w.ResponseWriter
+
+	if c.Request.Method != http.MethodGet || c.GetBool(noCacheKey) {
+		return
+	}
+	header := renderedHeader(before, w.Header())
+	if !cacheableResponse(w.Status(), header) {
+		return
+	}
+
+	now := time.Now()
+	entry := &pagecache.Entry{
+		Status:     w.Status(),
+		Header:     header,
+		Body:       w.body.String(),
+		StoredAt:   now,
+		FreshUntil: now.Add(pc.ttl),
+		StaleUntil: now.Add(pc.ttl + pc.stale),
+	}
+	if err := pc.store.Set(context.WithoutCancel(c.Request.Context()), key, entry); err != nil {
+		log.Printf("ssr cache set failed path=%s err=%v", key.Path, err)
+	}
+}
+
+// renderedHeader returns the headers the render added or changed, leaving
+// out those set by middleware before it.
+func renderedHeader(before, after http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range after {
+		if name == PageCacheHeader || slices.Equal(before[name], values) {
+			continue
+		}
+		out[name] = slices.Clone(values)
+	}
+	return out
+}
+
+func cacheableResponse(status int, header http.Header) bool {
+	if !cacheableStatus[status] || len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range header.Values("Cache-Control") {
+		v = strings.ToLower(v)
+		if strings.Contains(v, "no-store") || strings.Contains(v, "private") {
+			return false
+		}
+	}
+	return true
+}
+
+func writeCachedPage(c *gin.Context, e *pagecache.Entry, state string) {
+	h := c.Writer.Header()
+	for name, values := range e.Header {
+		h[name] = slices.Clone(values)
+	}
+	h.Set(PageCacheHeader, state)
+	h.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt).Seconds())))
+
+	c.Status(e.Status)
+	c.Writer.WriteHeaderNow()
+	if c.Request.Method != http.MethodHead {
+		io.WriteString(c.Writer, e.Body)
+	}
+}
+
+// captureWriter copies the body written through it.
+type captureWriter struct {
+	gin.ResponseWriter
+	body strings.Builder
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// pageCacheFromEnv builds the cache selected by SSR_CACHE (memory or redis),
+// or returns nil when it is off.
+func pageCacheFromEnv() *pageCache {
+	opts := PageCacheOptions{TTL: defaultPageCacheTTL, Stale: defaultPageCacheStale}
+	if v, ok := envDuration("SSR_CACHE_TTL"); ok {
+		opts.TTL = v
+	}
+	if v, ok := envDuration("SSR_CACHE_STALE"); ok {
+		opts.Stale = v
+	}
+	opts.Vary = splitList(os.Getenv("SSR_CACHE_VARY"))
+
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv("SSR_CACHE"))); backend {
+	case "":
+		return nil
+	case "memory":
+		size, _ := envInt("SSR_CACHE_SIZE")
+		return newPageCache(pagecache.NewMemory(size), opts)
+	case "redis":
+		client := xredis.Get()
+		if client == nil {
+			log.Printf("SSR_CACHE=redis but redis is not configured; page cache disabled")
+			return nil
+		}
+		return newPageCache(pagecache.NewRedis(client, os.Getenv("SSR_CACHE_PREFIX")), opts)
+	default:
+		log.Printf("unknown SSR_CACHE %q; page cache disabled", backend)
+		return nil
+	}
+}
+
+func envDuration(name string) (time.Duration, bool) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return 0, false
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
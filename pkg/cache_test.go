@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vitego/pkg/pagecache"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingRender renders the number of times it was called.
+type countingRender struct {
+	calls atomic.Int32
+}
+
+func (r *countingRender) render(c *gin.Context) {
+	n := r.calls.Add(1)
+	c.String(http.StatusOK, "render %d", n)
+}
+
+func serveCached(pc *pageCache, render gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	c.Set(requestVaryKey, pc.vary(req, nil))
+	pc.serve(c, render)
+	return w
+}
+
+// loopbackRouter serves loopback requests like RunApps, counting them.
+func loopbackRouter(served *atomic.Int32) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		served.Add(1)
+		c.Next()
+	})
+	router.NoRoute(func(c *gin.Context) {
+		if !runLoopback(c) {
+			c.Status(http.StatusNotFound)
+		}
+	})
+	return router
+}
+
+func TestPageCacheServe(t *testing.T) {
+	store := pagecache.NewMemory(0)
+	pc := newPageCache(store, PageCacheOptions{TTL: time.Minute, Stale: time.Minute})
+	var routed atomic.Int32
+	pc.router = loopbackRouter(&routed)
+	r := &countingRender{}
+	get := func() *httptest.ResponseRecorder {
+		return serveCached(pc, r.render, httptest.NewRequest(http.MethodGet, "http://example.com/page?b=2&a=1", nil))
+	}
+
+	if w := get(); w.Header().Get(PageCacheHeader) != "MISS" || w.Body.String() != "render 1" {
+		t.Fatalf("first request: %s %q, want MISS %q", w.Header().Get(PageCacheHeader), w.Body, "render 1")
+	}
+	if w := get(); w.Header().Get(PageCacheHeader) != "HIT" || w.Body.String() != "render 1" {
+		t.Fatalf("second request: %s %q, want HIT %q", w.Header().Get(PageCacheHeader), w.Body, "render 1")
+	}
+	w := serveCached(pc, r.render, httptest.NewRequest(http.MethodGet, "http://example.com/page?a=1&b=2", nil))
+	if w.Header().Get(PageCacheHeader) != "HIT" {
+		t.Fatalf("reordered query: %s, want HIT", w.Header().Get(PageCacheHeader))
+	}
+
+	// Make the stored page stale.
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/page?a=1&b=2", nil)
+	key, _ := pc.key(c)
+	entry, _ := store.Get(context.Background(), key)
+	stale := *entry
+	stale.FreshUntil = time.Now().Add(-time.Second)
+	store.Set(context.Background(), key, &stale)
+
+	if w := get(); w.Header().Get(PageCacheHeader) != "STALE" || w.Body.String() != "render 1" {
+		t.Fatalf("stale request: %s %q, want STALE %q", w.Header().Get(PageCacheHeader), w.Body, "render 1")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if e, _ := store.Get(context.Background(), key); e != nil && e.Body == "render 2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stale page was not rendered again in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if w := get(); w.Header().Get(PageCacheHeader) != "HIT" || w.Body.String() != "render 2" {
+		t.Fatalf("after revalidation: %s %q, want HIT %q", w.Header().Get(PageCacheHeader), w.Body, "render 2")
+	}
+	if calls := r.calls.Load(); calls != 2 {
+		t.Fatalf("rendered %d times, want 2", calls)
+	}
+	if n := routed.Load(); n != 1 {
+		t.Fatalf("%d requests went through the router, want the revalidation", n)
+	}
+}
+
+func TestPageCacheBypass(t *testing.T) {
+	pc := newPageCache(pagecache.NewMemory(0), PageCacheOptions{})
+	r := &countingRender{}
+
+	post := httptest.NewRequest(http.MethodPost, "http://example.com/page", nil)
+	session := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	session.AddCookie(&http.Cookie{Name: "session_token", Value: base64.StdEncoding.EncodeToString([]byte(`{"email":"a@example.com"}`))})
+
+	for name, req := range map[string]*http.Request{"POST": post, "session": session} {
+		for range 2 {
+			if w := serveCached(pc, r.render, req); w.Header().Get(PageCacheHeader) != "BYPASS" {
+				t.Errorf("%s request: %s, want BYPASS", name, w.Header().Get(PageCacheHeader))
+			}
+		}
+	}
+	if calls := r.calls.Load(); calls != 4 {
+		t.Errorf("rendered %d times, want 4", calls)
+	}
+}
+
+func TestPageCacheSkipsUncacheableResponses(t *testing.T) {
+	pc := newPageCache(pagecache.NewMemory(0), PageCacheOptions{})
+	var calls int
+	render := func(c *gin.Context) {
+		calls++
+		c.Header("Cache-Control", "private")
+		c.String(http.StatusOK, "private")
+	}
+
+	for range 2 {
+		serveCached(pc, render, httptest.NewRequest(http.MethodGet, "http://example.com/me", nil))
+	}
+	if calls != 2 {
+		t.Errorf("rendered %d times, want a private page rendered for every request", calls)
+	}
+}
+
+func TestPageCacheVary(t *testing.T) {
+	request := func(mobile, language string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		req.Header.Set("Sec-CH-UA-Mobile", mobile)
+		req.Header.Set("Accept-Language", language)
+		return req
+	}
+
+	t.Run("off by default", func(t *testing.T) {
+		pc := newPageCache(pagecache.NewMemory(0), PageCacheOptions{})
+		r := &countingRender{}
+		serveCached(pc, r.render, request("?0", "en-US,en;q=0.9"))
+		w := serveCached(pc, r.render, request("?1", "de-DE"))
+		if w.Header().Get(PageCacheHeader) != "HIT" {
+			t.Errorf("request with other headers: %s, want HIT", w.Header().Get(PageCacheHeader))
+		}
+		if v := w.Header().Get("Vary"); v != "" {
+			t.Errorf("Vary = %q without vary headers", v)
+		}
+	})
+
+	t.Run("opted in", func(t *testing.T) {
+		pc := newPageCache(pagecache.NewMemory(0), PageCacheOptions{Vary: []string{"sec-ch-ua-mobile", " Sec-CH-UA-Mobile"}})
+		r := &countingRender{}
+		serveCached(pc, r.render, request("?0", "en"))
+
+		tests := []struct {
+			mobile, language string
+			state, body      string
+		}{
+			{"?0", "de", "HIT", "render 1"},
+			{"?1", "en", "MISS", "render 2"},
+			{"?1", "fr", "HIT", "render 2"},
+		}
+		for _, tt := range tests {
+			w := serveCached(pc, r.render, request(tt.mobile, tt.language))
+			if got := w.Header().Get(PageCacheHeader); got != tt.state || w.Body.String() != tt.body {
+				t.Errorf("mobile %s language %s: %s %q, want %s %q", tt.mobile, tt.language, got, w.Body, tt.state, tt.body)
+			}
+			if v := w.Header().Values("Vary"); !slices.Equal(v, []string{"Sec-Ch-Ua-Mobile"}) {
+				t.Errorf("Vary = %q, want %q", v, "Sec-Ch-Ua-Mobile")
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// renderLogSize is how many recent renders, and separately how many recent
+// failures, Diagnose reports per app.
+const renderLogSize = 50
+
+// outcomeShed marks renders turned away by the queue budget or the breaker
+// in the render log.
+const outcomeShed = "shed"
+
+// Diagnostics is a snapshot of an app's renderer for investigating render
+// latency and memory in production.
+type Diagnostics struct {
+	App        string     `json:"app"`
+	Engine     string     `json:"engine"`
+	Bundle     BundleInfo `json:"bundle"`
+	BundleHash string     `json:"bundleHash"`
+	// Pool is a *renderer.PoolStats, reported by engines that keep
+	// isolates, i.e. the V8 engine.
+	Pool    any           `json:"pool,omitempty"`
+	Breaker BreakerStatus `json:"breaker"`
+	// Renders counts renders running or waiting for a slot, and
+	// RenderLimit how many may run at once: the render workers if the
+	// engine has any, otherwise SSR_RENDER_LIMIT, where 0 means no limit.
+	Renders     int `json:"renders"`
+	RenderLimit int `json:"renderLimit"`
+	// Recent lists the latest renders and Failures the latest failed ones,
+	// newest first.
+	Recent   []RenderRecord `json:"recent"`
+	Failures []RenderRecord `json:"failures"`
+}
+
+// RenderRecord describes one render of a request.
+type RenderRecord struct {
+	Time time.Time `json:"time"`
+	// RequestID is the error ID shown on the fallback page of a failed
+	// render and logged with its error.
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	Route     string `json:"route"`
+	Bot       bool   `json:"bot"`
+	// DurationMs includes the wait for a render slot.
+	DurationMs float64 `json:"durationMs"`
+	// Outcome is ok, error, timeout, panic or shed.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Diagnose reports the state of an app's renderer. An empty name means the
+// default app.
+func Diagnose(appName string) (Diagnostics, error) {
+	app, err := lookupApp(appName)
+	if err != nil {
+		return Diagnostics{}, err
+	}
+	return app.diagnostics(), nil
+}
+
+func (a *ssrApp) diagnostics() Diagnostics {
+	b := a.bundle.Load()
+	d := Diagnostics{
+		App:         a.name,
+		Engine:      fmt.Sprintf("%T", b.ssr),
+		Bundle:      b.info,
+		BundleHash:  b.ssr.BundleHash(),
+		Breaker:     a.breaker.status(),
+		Renders:     int(a.renders.Load()),
+		RenderLimit: a.renderSlots(),
+		Pool:        enginePool(b.ssr),
+	}
+	d.Recent, d.Failures = a.renderLog.snapshot()
+	return d
+}
+
+// logRender adds a render of c that started at start to the render log.
+func (a *ssrApp) logRender(ctx context.Context, c *gin.Context, route string, start time.Time, err error) {
+	record := RenderRecord{
+		Time:       start,
+		RequestID:  renderer.RequestIDFromContext(ctx),
+		Path:       c.Request.URL.Path,
+		Route:      route,
+		Bot:        IsBot(c.Request.UserAgent()),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Outcome:    renderOutcome(err),
+	}
+	if errors.Is(err, errRenderShed) {
+		record.Outcome = outcomeShed
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	a.renderLog.add(record)
+}
+
+// renderLog keeps the latest renders and failed renders of an app.
+type renderLog struct {
+	mu       sync.Mutex
+	recent   []RenderRecord
+	failures []RenderRecord
+}
+
+func (l *renderLog) add(record RenderRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = appendBounded(l.recent, record)
+	if record.Error != "" && record.Outcome != outcomeShed {
+		l.failures = appendBounded(l.failures, record)
+	}
+}
+
+// snapshot returns copies of both lists, newest first.
+func (l *renderLog) snapshot() (recent, failures []RenderRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return newestFirst(l.recent), newestFirst(l.failures)
+}
+
+func appendBounded(records []RenderRecord, record RenderRecord) []RenderRecord {
+	if len(records) == renderLogSize {
+		records = append(records[:0], records[1:]...)
+	}
+	return append(records, record)
+}
+
+func newestFirst(records []RenderRecord) []RenderRecord {
+	out := make([]RenderRecord, len(records))
+	for i, record := range records {
+		out[len(records)-1-i] = record
+	}
+	return out
+}
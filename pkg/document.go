@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"errors"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// document is index.html with the positions SSR output is merged into,
+// located once with an HTML tokenizer. Rendering splices the original bytes
+// so the rest of the file is left exactly as Vite built it.
+type document struct {
+	src string
+
+	htmlTag  tagSpan
+	bodyTag  tagSpan
+	headEnd  int
+	bodyEnd  int
+	appStart int
+	appEnd   int
+}
+
+// tagSpan is the byte range of a start tag and its parsed attributes.
+type tagSpan struct {
+	start, end int
+	name       string
+	attrs      []xhtml.Attribute
+}
+
+// pageParts is what gets merged into the document around the app HTML.
+type pageParts struct {
+	HTMLAttrs map[string]string
+	BodyAttrs map[string]string
+	// Head is inserted before </head>.
+	Head string
+	// BodyEnd is inserted before </body>.
+	BodyEnd string
+}
+
+type documentEdit struct {
+	start, end int
+	text       string
+}
+
+func parseDocument(src string) (*document, error) {
+	d := &document{src: src, headEnd: -1, bodyEnd: -1, appStart: -1}
+	d.htmlTag.start, d.bodyTag.start = -1, -1
+
+	z := xhtml.NewTokenizer(strings.NewReader(src))
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+
+		start := offset
+		offset += len(z.Raw())
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			tok := z.Token()
+			switch {
+			case tok.Data == "html" && d.htmlTag.start < 0:
+				d.htmlTag = tagSpan{start: start, end: offset, name: tok.Data, attrs: tok.Attr}
+			case tok.Data == "body" && d.bodyTag.start < 0:
+				d.bodyTag = tagSpan{start: start, end: offset, name: tok.Data, attrs: tok.Attr}
+			}
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			switch {
+			case string(name) == "head" && d.headEnd < 0:
+				d.headEnd = start
+			case string(name) == "body" && d.bodyEnd < 0:
+				d.bodyEnd = start
+			}
+		case xhtml.CommentToken:
+			if d.appStart < 0 && string(z.Raw()) == appHTMLPlaceholder {
+				d.appStart, d.appEnd = start, offset
+			}
+		}
+	}
+
+	if d.appStart < 0 {
+		return nil, errors.New("index.html has no " + appHTMLPlaceholder + " placeholder")
+	}
+	if d.headEnd < 0 {
+		// Without </head>, head content goes right before <body>, or first.
+		d.headEnd = max(d.bodyTag.start, 0)
+	}
+	if d.bodyEnd < 0 {
+		d.bodyEnd = len(src)
+	}
+
+	return d, nil
+}
+
+// split merges p into the document and returns the parts before and after
+// the app placeholder.
+func (d *document) split(p pageParts) (shell string, tail string) {
+	edits := []documentEdit{{start: d.appStart, end: d.appEnd}}
+	if d.htmlTag.start >= 0 && len(p.HTMLAttrs) > 0 {
+		edits = append(edits, documentEdit{d.htmlTag.start, d.htmlTag.end, d.htmlTag.merge(p.HTMLAttrs)})
+	}
+	if d.bodyTag.start >= 0 && len(p.BodyAttrs) > 0 {
+		edits = append(edits, documentEdit{d.bodyTag.start, d.bodyTag.end, d.bodyTag.merge(p.BodyAttrs)})
+	}
+	if p.Head != "" {
+		edits = append(edits, documentEdit{d.headEnd, d.headEnd, withNewline(p.Head)})
+	}
+	if p.BodyEnd != "" {
+		edits = append(edits, documentEdit{d.bodyEnd, d.bodyEnd, p.BodyEnd})
+	}
+	// Inserts sort before a tag replaced at the same offset.
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].end < edits[j].end
+	})
+
+	var b strings.Builder
+	pos := 0
+	for _, e := range edits {
+		b.WriteString(d.src[pos:e.start])
+		if e.start == d.appStart && e.end == d.appEnd {
+			shell = b.String()
+			b.Reset()
+		} else {
+			b.WriteString(e.text)
+		}
+		pos = e.end
+	}
+	b.WriteString(d.src[pos:])
+
+	return shell, b.String()
+}
+
+// render returns the whole page with appHTML in place of the placeholder.
+func (d *document) render(p pageParts, appHTML string) string {
+	shell, tail := d.split(p)
+	return shell + appHTML + tail
+}
+
+// merge returns the start tag with attrs applied. Existing attributes keep
+// their order; class values are appended, anything else is replaced.
+func (t tagSpan) merge(attrs map[string]string) string {
+	out := make([]xhtml.Attribute, 0, len(t.attrs)+len(attrs))
+	seen := map[string]bool{}
+	for _, a := range t.attrs {
+		if v, ok := attrs[a.Key]; ok && validAttrName(a.Key) {
+			if a.Key == "class" {
+				v = mergeClasses(a.Val, v)
+			}
+			a.Val = v
+		}
+		seen[a.Key] = true
+		out = append(out, a)
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		if !seen[k] && validAttrName(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out = append(out, xhtml.Attribute{Key: k, Val: attrs[k]})
+	}
+
+	var b strings.Builder
+	b.WriteString("<" + t.name)
+	for _, a := range out {
+		b.WriteString(" " + a.Key)
+		if a.Val != "" {
+			b.WriteString(`="` + html.EscapeString(a.Val) + `"`)
+		}
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+func mergeClasses(existing, added string) string {
+	classes := strings.Fields(existing)
+	for _, c := range strings.Fields(added) {
+		found := false
+		for _, e := range classes {
+			if e == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			classes = append(classes, c)
+		}
+	}
+	return strings.Join(classes, " ")
+}
+
+// validAttrName accepts the attribute names server.js may set; anything that
+// could break out of the tag is dropped.
+func validAttrName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return false
+		default:
+			return !strings.ContainsRune("-_:.", r)
+		}
+	}) == -1
+}
+
+func withNewline(s string) string {
+	if strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustParseDocument(t *testing.T, src string) *document {
+	t.Helper()
+	doc, err := parseDocument(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestDocumentRender(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		parts pageParts
+		want  string
+	}{
+		{
+			name:  "head, body end and app",
+			src:   `<html><head><title>x</title></head><body><div id="app"><!--app-html--></div></body></html>`,
+			parts: pageParts{Head: "<meta a>", BodyEnd: "<script>s</script>"},
+			want:  `<html><head><title>x</title><meta a>` + "\n" + `</head><body><div id="app">APP</div><script>s</script></body></html>`,
+		},
+		{
+			name:  "markup inside scripts is not matched",
+			src:   `<html><head><script>const s = "</head><!--app-html--></body>"</script></head><body><!--app-html--></body></html>`,
+			parts: pageParts{Head: "<meta a>", BodyEnd: "<i></i>"},
+			want:  `<html><head><script>const s = "</head><!--app-html--></body>"</script><meta a>` + "\n" + `</head><body>APP<i></i></body></html>`,
+		},
+		{
+			name:  "head goes before body without </head>",
+			src:   `<html><body><!--app-html--></body></html>`,
+			parts: pageParts{Head: "<meta a>"},
+			want:  `<html><meta a>` + "\n" + `<body>APP</body></html>`,
+		},
+		{
+			name:  "body end is appended without </body>",
+			src:   `<!--app-html-->`,
+			parts: pageParts{BodyEnd: "<i></i>"},
+			want:  `APP<i></i>`,
+		},
+		{
+			name: "attributes are merged",
+			src:  `<html lang="en" data-x><head></head><body class="a b"><!--app-html--></body></html>`,
+			parts: pageParts{
+				HTMLAttrs: map[string]string{"lang": "de", "dir": "ltr"},
+				BodyAttrs: map[string]string{"class": "b c", "data-q": `"><script>`, "on load": "x"},
+			},
+			want: `<html lang="de" data-x dir="ltr"><head></head><body class="a b c" data-q="&#34;&gt;&lt;script&gt;">APP</body></html>`,
+		},
+		{
+			name: "only the first html and body tags are merged",
+			src:  `<html><head></head><body><template><body></body></template><!--app-html--></body></html>`,
+			parts: pageParts{
+				BodyAttrs: map[string]string{"class": "x"},
+			},
+			want: `<html><head></head><body class="x"><template><body></body></template>APP</body></html>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustParseDocument(t, tt.src).render(tt.parts, "APP")
+			if got != tt.want {
+				t.Errorf("render:\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentSplit(t *testing.T) {
+	doc := mustParseDocument(t, `<html><head></head><body><div id="app"><!--app-html--></div></body></html>`)
+
+	shell, tail := doc.split(pageParts{Head: "<title>t</title>", BodyEnd: "<i></i>"})
+	if want := "<html><head><title>t</title>\n</head><body><div id=\"app\">"; shell != want {
+		t.Errorf("shell = %q, want %q", shell, want)
+	}
+	if want := "</div><i></i></body></html>"; tail != want {
+		t.Errorf("tail = %q, want %q", tail, want)
+	}
+}
+
+func TestDocumentKeepsSource(t *testing.T) {
+	src := "<!doctype html>\n<html>\n  <head>\n    <link rel=stylesheet href=/a.css>\n  </head>\n  <body>\n    <!--app-html-->\n  </body>\n</html>\n"
+	got := mustParseDocument(t, src).render(pageParts{}, "APP")
+	if want := strings.Replace(src, appHTMLPlaceholder, "APP", 1); got != want {
+		t.Errorf("render without parts changed the document:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDocumentWithoutPlaceholder(t *testing.T) {
+	if _, err := parseDocument(`<html><body><div id="app"></div></body></html>`); err == nil {
+		t.Fatal("parseDocument accepted index.html without the app placeholder")
+	}
+}
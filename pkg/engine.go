@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Engines SSR_ENGINE selects.
+const (
+	engineV8   = "v8"
+	engineNode = "node"
+)
+
+// EngineFactory starts a renderer for the server build in serverDist, whose
+// entry is server.js.
+type EngineFactory func(serverDist fs.FS) (renderer.Engine, error)
+
+// WithEngine renders with engines started by factory instead of the one
+// SSR_ENGINE selects. factory runs again for every bundle swapped in.
+func WithEngine(factory EngineFactory) RunOption {
+	return func(o *runOptions) {
+		o.engine = factory
+	}
+}
+
+// newEngine starts the renderer for serverDist: v8 runs server.js in
+// embedded isolates, node in a supervised Node.js worker process.
+func (a *ssrApp) newEngine(serverDist fs.FS) (renderer.Engine, error) {
+	if a.opts.engine != nil {
+		return a.opts.engine(serverDist)
+	}
+
+	switch name := engineName(); name {
+	case engineV8:
+		return newV8Engine(serverDist, a.router, a.renderLimit)
+	case engineNode:
+		ssr, err := renderer.NewNodeRenderer(serverDist, serverEntryName, nodeOptions(a.router))
+		if err != nil {
+			return nil, err
+		}
+		return ssr, nil
+	default:
+		return nil, fmt.Errorf("unknown SSR_ENGINE %q", name)
+	}
+}
+
+func engineName() string {
+	if name := strings.ToLower(strings.TrimSpace(os.Getenv("SSR_ENGINE"))); name != "" {
+		return name
+	}
+	return defaultEngine
+}
+
+// nodeOptions configures the node engine. SSR_NODE_BIN names the binary,
+// SSR_NODE_ARGS adds flags and SSR_NODE_DIR sets the directory node_modules
+// are resolved from. fetch() is served in-process as with the v8 engine.
+func nodeOptions(router *gin.Engine) renderer.NodeOptions {
+	opts := renderer.NodeOptions{
+		Command:      strings.TrimSpace(os.Getenv("SSR_NODE_BIN")),
+		Args:         strings.Fields(os.Getenv("SSR_NODE_ARGS")),
+		Dir:          strings.TrimSpace(os.Getenv("SSR_NODE_DIR")),
+		FetchHandler: router,
+		Fetch:        fetchOptions(),
+	}
+	if v, ok := envInt("SSR_CONSOLE_MAX_LINES"); ok {
+		opts.ConsoleMaxLines = v
+	}
+	return opts
+}
@@ -0,0 +1,25 @@
+//go:build !cgo
+
+package pkg
+
+import (
+	"errors"
+	"io/fs"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultEngine is the engine used without SSR_ENGINE. Builds without cgo
+// have no V8.
+const defaultEngine = engineNode
+
+func newV8Engine(fs.FS, *gin.Engine, int) (renderer.Engine, error) {
+	return nil, errors.New("the v8 engine needs a build with cgo; set SSR_ENGINE=node")
+}
+
+// enginePool returns nil, as only the v8 engine keeps isolates.
+func enginePool(renderer.Engine) any {
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build cgo
+
+package pkg
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultEngine is the engine used without SSR_ENGINE.
+const defaultEngine = engineV8
+
+// newV8Engine renders serverDist in embedded V8 isolates.
+func newV8Engine(serverDist fs.FS, router *gin.Engine, renderLimit int) (renderer.Engine, error) {
+	ssr, err := renderer.NewRenderer(serverDist, serverEntryName, rendererOptions(router, renderLimit)...)
+	if err != nil {
+		return nil, err
+	}
+	return ssr, nil
+}
+
+// enginePool returns the isolate pool of ssr as a *renderer.PoolStats, or
+// nil for engines that keep no isolates.
+func enginePool(ssr renderer.Engine) any {
+	if s, ok := ssr.(interface{ Stats() renderer.PoolStats }); ok {
+		stats := s.Stats()
+		return &stats
+	}
+	return nil
+}
+
+func rendererOptions(router *gin.Engine, renderLimit int) []renderer.Option {
+	opts := []renderer.Option{
+		renderer.WithPoolOptions(poolOptions(renderLimit)),
+		renderer.WithFetch(router, fetchOptions()),
+	}
+	if v, ok := envInt("SSR_RENDER_WORKERS"); ok && v > 0 {
+		opts = append(opts, renderer.WithWorkers(v))
+	}
+	if v, ok := envInt("SSR_CONSOLE_MAX_LINES"); ok {
+		opts = append(opts, renderer.WithConsoleLineLimit(v))
+	}
+	if raw := strings.TrimSpace(os.Getenv("SSR_POLYFILLS")); raw != "" {
+		polyfills, err := renderer.ParsePolyfills(raw)
+		if err != nil {
+			log.Fatalf("invalid SSR_POLYFILLS: %v", err)
+		}
+		opts = append(opts, renderer.WithPolyfills(polyfills))
+	}
+	return opts
+}
+
+// poolOptions reads the isolate pool policy from SSR_POOL_* variables. The
+// pool size defaults to the render concurrency limit. SSR_CODE_CACHE_DIR
+// persists the compiled bundle's code cache between restarts.
+func poolOptions(renderLimit int) renderer.PoolOptions {
+	opts := renderer.PoolOptions{
+		MinIsolates: 1,
+		MaxIsolates: renderLimit,
+	}
+
+	if v, ok := envInt("SSR_POOL_MIN"); ok {
+		opts.MinIsolates = v
+	}
+	if v, ok := envInt("SSR_POOL_MAX"); ok {
+		opts.MaxIsolates = v
+	}
+	if v, ok := envInt("SSR_POOL_MAX_RENDERS"); ok {
+		opts.MaxRendersPerIsolate = v
+	}
+	if raw := strings.TrimSpace(os.Getenv("SSR_POOL_MAX_AGE")); raw != "" {
+		if v, err := time.ParseDuration(raw); err == nil && v >= 0 {
+			opts.MaxIsolateAge = v
+		}
+	}
+	if v, ok := envInt("SSR_POOL_MAX_HEAP_MB"); ok {
+		opts.MaxHeapSize = uint64(v) << 20
+	}
+	if v, ok := envInt("SSR_POOL_MAX_HEAP_GROWTH_MB"); ok {
+		opts.MaxHeapGrowth = uint64(v) << 20
+	}
+	if v, ok := envInt("SSR_POOL_HEAP_LIMIT_MB"); ok {
+		opts.HeapLimit = uint64(v) << 20
+	}
+	opts.CodeCacheDir = strings.TrimSpace(os.Getenv("SSR_CODE_CACHE_DIR"))
+
+	return opts
+}
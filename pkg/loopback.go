@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loopbackKey holds, in the context of a request the server makes to itself,
+// the handler that serves it; see serveLoopback.
+type loopbackKey struct{}
+
+// serveLoopback serves req, a request the server makes to itself such as a
+// background revalidation, through router: the engine gives it a context
+// and runs its middleware like for any request, and the NoRoute handler of
+// RunApps or Prerender hands it to handler instead of an app. It fails when
+// a route of router takes req first.
+func serveLoopback(router http.Handler, req *http.Request, handler gin.HandlerFunc) (*loopbackWriter, error) {
+	served := false
+	serve := gin.HandlerFunc(func(c *gin.Context) {
+		served = true
+		handler(c)
+	})
+
+	w := newLoopbackWriter()
+	router.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), loopbackKey{}, serve)))
+	if !served {
+		return w, fmt.Errorf("%s %s is served by another route", req.Method, req.URL.Path)
+	}
+	return w, nil
+}
+
+// runLoopback serves c if it is a request made by serveLoopback and reports
+// whether it was.
+func runLoopback(c *gin.Context) bool {
+	handler, ok := c.Request.Context().Value(loopbackKey{}).(gin.HandlerFunc)
+	if ok {
+		handler(c)
+	}
+	return ok
+}
+
+// loopbackWriter keeps the response to a loopback request in memory.
+type loopbackWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newLoopbackWriter() *loopbackWriter {
+	return &loopbackWriter{header: http.Header{}}
+}
+
+func (w *loopbackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *loopbackWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *loopbackWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// Flush does nothing; gin requires an http.Flusher to stream pages.
+func (w *loopbackWriter) Flush() {}
+
+// Status returns the response status, 200 if none was written.
+func (w *loopbackWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+
+	"vitego/pkg/renderer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Render outcomes used as the outcome label.
+const (
+	outcomeOK      = "ok"
+	outcomeError   = "error"
+	outcomeTimeout = "timeout"
+	outcomePanic   = "panic"
+)
+
+// otherRoute labels paths the route labeler does not recognize.
+const otherRoute = "other"
+
+var errRenderPanic = errors.New("render panicked")
+
+var (
+	renderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "render_duration_seconds",
+		Help:      "Duration of SSR renders after leaving the queue, by route pattern and outcome.",
+	}, []string{"route", "outcome"})
+	renderTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "render_timeouts_total",
+		Help:      "SSR renders, including their queue wait, that ran out of time.",
+	})
+	renderPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "render_panics_total",
+		Help:      "SSR renders that panicked.",
+	})
+	renderFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "render_fallbacks_total",
+		Help:      "Responses served as the client-side rendered fallback page.",
+	})
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "queue_wait_seconds",
+		Help:      "Time spent waiting for a render slot.",
+	})
+	renderDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "render_decisions_total",
+		Help:      "Render policy decisions, by mode (ssr, csr or prerendered) and client (bot or human).",
+	}, []string{"mode", "client"})
+	rendersShed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "renders_shed_total",
+		Help:      "Renders turned away and served the client-side rendered page, by reason: queue or breaker.",
+	}, []string{"reason"})
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ssr",
+		Name:      "breaker_state",
+		Help:      "1 for the current circuit breaker state of each app: closed, open or half_open.",
+	}, []string{"app", "state"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "breaker_transitions_total",
+		Help:      "Circuit breaker state changes, by app and new state.",
+	}, []string{"app", "state"})
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ssr",
+		Name:      "queue_depth",
+		Help:      "Requests currently waiting for a render slot.",
+	})
+	dataFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "data_fetch_duration_seconds",
+		Help:      "Duration of the backend data fetcher that builds the SSR payload, by outcome.",
+	}, []string{"outcome"})
+	pageCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "page_cache_requests_total",
+		Help:      "Page cache lookups by result: hit, stale, miss or bypass.",
+	}, []string{"result"})
+)
+
+// renderOutcome classifies a render error for the outcome label.
+func renderOutcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeOK
+	case errors.Is(err, errRenderPanic), errors.Is(err, renderer.ErrRenderPanic):
+		return outcomePanic
+	case errors.Is(err, context.DeadlineExceeded):
+		return outcomeTimeout
+	default:
+		return outcomeError
+	}
+}
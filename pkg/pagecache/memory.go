@@ -0,0 +1,109 @@
+package pagecache
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMemoryEntries = 1000
+
+// Memory is an in-process LRU store. Every replica has its own, so purges
+// only reach the process they are called in.
+type Memory struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   Key
+	entry *Entry
+}
+
+// NewMemory returns an LRU store holding up to maxEntries pages; a value
+// below 1 selects the default of 1000.
+func NewMemory(maxEntries int) *Memory {
+	if maxEntries < 1 {
+		maxEntries = defaultMemoryEntries
+	}
+	return &Memory{
+		max:     maxEntries,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (m *Memory) Get(_ context.Context, key Key) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key.String()]
+	if !ok {
+		return nil, nil
+	}
+	item := el.Value.(*memoryItem)
+	if !item.entry.Usable(time.Now()) {
+		m.remove(el)
+		return nil, nil
+	}
+	m.order.MoveToFront(el)
+	return item.entry, nil
+}
+
+func (m *Memory) Set(_ context.Context, key Key, e *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := key.String()
+	if el, ok := m.entries[k]; ok {
+		el.Value.(*memoryItem).entry = e
+		m.order.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[k] = m.order.PushFront(&memoryItem{key: key, entry: e})
+	for m.order.Len() > m.max {
+		m.remove(m.order.Back())
+	}
+	return nil
+}
+
+func (m *Memory) Purge(_ context.Context, path string) (int, error) {
+	return m.purge(func(p string) bool { return p == path }), nil
+}
+
+func (m *Memory) PurgePrefix(_ context.Context, prefix string) (int, error) {
+	return m.purge(func(p string) bool { return strings.HasPrefix(p, prefix) }), nil
+}
+
+// Len returns the number of stored entries.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+func (m *Memory) purge(match func(path string) bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*memoryItem).key.Path) {
+			m.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+func (m *Memory) remove(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.entries, el.Value.(*memoryItem).key.String())
+}
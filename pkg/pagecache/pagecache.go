@@ -0,0 +1,66 @@
+// Package pagecache stores rendered SSR responses.
+//
+// Entries carry their own freshness: a fresh entry is served as is, a stale
+// one may be served while it is rendered again, and the store drops it once
+// StaleUntil has passed.
+package pagecache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key identifies a cached page.
+type Key struct {
+	Path string
+	// Query is the encoded, sorted query string.
+	Query string
+	// Origin is the scheme and host the page was rendered for; absolute
+	// links in the page depend on it.
+	Origin string
+	Locale string
+	// Vary encodes the request headers the cache varies by and the
+	// cookies server.js was allowed to see.
+	Vary string
+}
+
+// String returns the key with the path first, so stores can purge by path
+// prefix.
+func (k Key) String() string {
+	return strings.Join([]string{k.Path, k.Query, k.Origin, k.Locale, k.Vary}, "\x00")
+}
+
+// Entry is a cached response.
+type Entry struct {
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+	StoredAt   time.Time   `json:"storedAt"`
+	FreshUntil time.Time   `json:"freshUntil"`
+	StaleUntil time.Time   `json:"staleUntil"`
+}
+
+// Fresh reports whether e can be served without rendering again.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.FreshUntil)
+}
+
+// Usable reports whether e can still be served, fresh or stale.
+func (e *Entry) Usable(now time.Time) bool {
+	return now.Before(e.StaleUntil)
+}
+
+// Store is a page cache backend.
+type Store interface {
+	// Get returns the entry for key, or nil if there is none.
+	Get(ctx context.Context, key Key) (*Entry, error)
+	// Set stores e until e.StaleUntil.
+	Set(ctx context.Context, key Key, e *Entry) error
+	// Purge removes every entry for path, whatever its query, origin,
+	// locale or vary, and returns how many were removed.
+	Purge(ctx context.Context, path string) (int, error)
+	// PurgePrefix removes every entry whose path starts with prefix.
+	PurgePrefix(ctx context.Context, prefix string) (int, error)
+}
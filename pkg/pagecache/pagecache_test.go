@@ -0,0 +1,199 @@
+package pagecache
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func entryFor(body string, fresh, stale time.Duration) *Entry {
+	now := time.Now()
+	return &Entry{
+		Status:     200,
+		Body:       body,
+		StoredAt:   now,
+		FreshUntil: now.Add(fresh),
+		StaleUntil: now.Add(fresh + stale),
+	}
+}
+
+func TestEntryFreshness(t *testing.T) {
+	now := time.Now()
+	e := &Entry{FreshUntil: now.Add(time.Minute), StaleUntil: now.Add(2 * time.Minute)}
+
+	tests := []struct {
+		at            time.Time
+		fresh, usable bool
+	}{
+		{now, true, true},
+		{now.Add(90 * time.Second), false, true},
+		{now.Add(3 * time.Minute), false, false},
+	}
+	for _, tt := range tests {
+		if got := e.Fresh(tt.at); got != tt.fresh {
+			t.Errorf("Fresh(%v) = %v, want %v", tt.at.Sub(now), got, tt.fresh)
+		}
+		if got := e.Usable(tt.at); got != tt.usable {
+			t.Errorf("Usable(%v) = %v, want %v", tt.at.Sub(now), got, tt.usable)
+		}
+	}
+}
+
+// testStore runs the behaviour every Store shares against an empty store.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	mustSet := func(key Key, e *Entry) {
+		t.Helper()
+		if err := store.Set(ctx, key, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := func(key Key) string {
+		t.Helper()
+		e, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			return ""
+		}
+		return e.Body
+	}
+
+	t.Run("get and set", func(t *testing.T) {
+		key := Key{Path: "/get", Query: "a=1", Origin: "http://example.com", Locale: "en"}
+		if got := body(key); got != "" {
+			t.Fatalf("Get on an empty store returned %q", got)
+		}
+		mustSet(key, entryFor("page", time.Minute, time.Minute))
+		if got := body(key); got != "page" {
+			t.Fatalf("Get = %q, want %q", got, "page")
+		}
+		for _, other := range []Key{
+			{Path: "/get", Query: "a=2", Origin: key.Origin, Locale: key.Locale},
+			{Path: "/get", Query: key.Query, Origin: "https://example.com", Locale: key.Locale},
+			{Path: "/get", Query: key.Query, Origin: key.Origin, Locale: "de"},
+			{Path: "/get", Query: key.Query, Origin: key.Origin, Locale: key.Locale, Vary: "x"},
+		} {
+			if got := body(other); got != "" {
+				t.Errorf("Get(%+v) returned the page stored for %+v", other, key)
+			}
+		}
+	})
+
+	t.Run("stale entries are served until they expire", func(t *testing.T) {
+		stale := Key{Path: "/stale"}
+		mustSet(stale, &Entry{Body: "stale", FreshUntil: time.Now().Add(-time.Second), StaleUntil: time.Now().Add(time.Minute)})
+		if got := body(stale); got != "stale" {
+			t.Fatalf("Get = %q for a stale entry, want %q", got, "stale")
+		}
+
+		expiring := Key{Path: "/expiring"}
+		mustSet(expiring, entryFor("expiring", 0, 1100*time.Millisecond))
+		time.Sleep(1500 * time.Millisecond)
+		if got := body(expiring); got != "" {
+			t.Fatalf("Get = %q after StaleUntil, want no entry", got)
+		}
+	})
+
+	t.Run("purge by path", func(t *testing.T) {
+		mustSet(Key{Path: "/p", Query: "a=1"}, entryFor("1", time.Minute, 0))
+		mustSet(Key{Path: "/p", Locale: "de"}, entryFor("2", time.Minute, 0))
+		mustSet(Key{Path: "/p/child"}, entryFor("3", time.Minute, 0))
+		mustSet(Key{Path: "/pp"}, entryFor("4", time.Minute, 0))
+
+		n, err := store.Purge(ctx, "/p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("Purge removed %d entries, want 2", n)
+		}
+		if body(Key{Path: "/p", Query: "a=1"}) != "" || body(Key{Path: "/p", Locale: "de"}) != "" {
+			t.Error("Purge left a variant of the path")
+		}
+		if body(Key{Path: "/p/child"}) == "" || body(Key{Path: "/pp"}) == "" {
+			t.Error("Purge removed another path")
+		}
+	})
+
+	t.Run("purge by prefix", func(t *testing.T) {
+		mustSet(Key{Path: "/blog/a"}, entryFor("a", time.Minute, 0))
+		mustSet(Key{Path: "/blog/b", Query: "page=2"}, entryFor("b", time.Minute, 0))
+		mustSet(Key{Path: "/blogroll"}, entryFor("r", time.Minute, 0))
+		mustSet(Key{Path: "/docs"}, entryFor("d", time.Minute, 0))
+
+		n, err := store.PurgePrefix(ctx, "/blog/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("PurgePrefix removed %d entries, want 2", n)
+		}
+		if body(Key{Path: "/blog/a"}) != "" || body(Key{Path: "/blog/b", Query: "page=2"}) != "" {
+			t.Error("PurgePrefix left a page under the prefix")
+		}
+		if body(Key{Path: "/blogroll"}) == "" || body(Key{Path: "/docs"}) == "" {
+			t.Error("PurgePrefix removed a page outside the prefix")
+		}
+	})
+
+	t.Run("patterns in paths are literal", func(t *testing.T) {
+		mustSet(Key{Path: "/a*"}, entryFor("star", time.Minute, 0))
+		mustSet(Key{Path: "/ab"}, entryFor("ab", time.Minute, 0))
+
+		if _, err := store.Purge(ctx, "/a*"); err != nil {
+			t.Fatal(err)
+		}
+		if body(Key{Path: "/a*"}) != "" {
+			t.Error("Purge did not remove a path with a glob character")
+		}
+		if body(Key{Path: "/ab"}) == "" {
+			t.Error("Purge treated * in the path as a pattern")
+		}
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory(0))
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(2)
+	m.Set(ctx, Key{Path: "/a"}, entryFor("a", time.Minute, 0))
+	m.Set(ctx, Key{Path: "/b"}, entryFor("b", time.Minute, 0))
+	m.Get(ctx, Key{Path: "/a"})
+	m.Set(ctx, Key{Path: "/c"}, entryFor("c", time.Minute, 0))
+
+	if e, _ := m.Get(ctx, Key{Path: "/b"}); e != nil {
+		t.Error("the least recently used entry was kept")
+	}
+	if e, _ := m.Get(ctx, Key{Path: "/a"}); e == nil {
+		t.Error("a recently read entry was evicted")
+	}
+	if n := m.Len(); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+}
+
+// TestRedis needs a server: set PAGECACHE_TEST_REDIS to its address. The
+// test uses its own key prefix and removes its keys.
+func TestRedis(t *testing.T) {
+	addr := os.Getenv("PAGECACHE_TEST_REDIS")
+	if addr == "" {
+		t.Skip("PAGECACHE_TEST_REDIS is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewRedis(client, "pagecache-test:"+time.Now().Format("150405.000000")+":")
+	t.Cleanup(func() { store.PurgePrefix(context.Background(), "/") })
+	testStore(t, store)
+}
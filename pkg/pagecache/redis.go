@@ -0,0 +1,117 @@
+package pagecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPrefix namespaces page cache keys.
+const DefaultRedisPrefix = "ssr:page:"
+
+const redisScanCount = 500
+
+// Redis stores pages in Redis as JSON, shared by every replica. Keys expire
+// when their entries stop being usable.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis returns a store using client, with keys under prefix; an empty
+// prefix selects DefaultRedisPrefix.
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) Get(ctx context.Context, key Key) (*Entry, error) {
+	raw, err := r.client.Get(ctx, r.prefix+key.String()).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var e Entry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key Key, e *Entry) error {
+	ttl := time.Until(e.StaleUntil)
+	if ttl <= 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.prefix+key.String(), raw, ttl).Err()
+}
+
+func (r *Redis) Purge(ctx context.Context, path string) (int, error) {
+	return r.deleteMatching(ctx, globEscape(r.prefix+path)+"\x00*")
+}
+
+func (r *Redis) PurgePrefix(ctx context.Context, prefix string) (int, error) {
+	return r.deleteMatching(ctx, globEscape(r.prefix+prefix)+"*")
+}
+
+// deleteMatching scans every master of a cluster, since SCAN only walks the
+// node it is sent to.
+func (r *Redis) deleteMatching(ctx context.Context, pattern string) (int, error) {
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return scanDelete(ctx, r.client, pattern)
+	}
+
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		deleted, err := scanDelete(ctx, node, pattern)
+		mu.Lock()
+		n += deleted
+		mu.Unlock()
+		return err
+	})
+	return n, err
+}
+
+func scanDelete(ctx context.Context, c redis.Cmdable, pattern string) (int, error) {
+	n := 0
+	iter := c.Scan(ctx, 0, pattern, redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		deleted, err := c.Del(ctx, iter.Val()).Result()
+		if err != nil {
+			return n, err
+		}
+		n += int(deleted)
+	}
+	return n, iter.Err()
+}
+
+// globEscape quotes the characters SCAN MATCH treats as patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RenderMode is how a request is answered.
+type RenderMode string
+
+const (
+	// RenderSSR renders the page, through the page cache if there is one.
+	RenderSSR RenderMode = "ssr"
+	// RenderCSR serves the client-side rendered shell instead of rendering.
+	// Page cache hits are still served.
+	RenderCSR RenderMode = "csr"
+	// RenderPrerendered serves the prerendered page, or renders it when
+	// there is none.
+	RenderPrerendered RenderMode = "prerendered"
+)
+
+// csrOnlyKey marks a request the policy gave the CSR shell.
+const csrOnlyKey = "ssr.csr"
+
+// PolicyRequest is what a RenderPolicy decides on.
+type PolicyRequest struct {
+	Request *http.Request
+	// Bot reports whether the User-Agent belongs to a crawler.
+	Bot bool
+	// Prerendered reports whether there is a prerendered page for the
+	// request.
+	Prerendered bool
+	// Renders counts the app's renders running or waiting for a slot, and
+	// RenderLimit how many may run at once, the render workers if there
+	// are any; 0 means no limit.
+	Renders     int
+	RenderLimit int
+}
+
+// Busy reports whether every render slot is taken, so another render would
+// have to wait.
+func (r PolicyRequest) Busy() bool {
+	return r.RenderLimit > 0 && r.Renders >= r.RenderLimit
+}
+
+// RenderPolicy decides per request how it is answered.
+type RenderPolicy func(PolicyRequest) RenderMode
+
+// WithRenderPolicy replaces DefaultRenderPolicy.
+func WithRenderPolicy(policy RenderPolicy) RunOption {
+	return func(o *runOptions) {
+		o.policy = policy
+	}
+}
+
+// DefaultRenderPolicy serves prerendered pages where there are some and
+// renders everything else, except that people get the CSR shell while all
+// render slots are busy. Crawlers are never given the CSR shell, so the
+// renderer is kept for the requests search engines see.
+func DefaultRenderPolicy(r PolicyRequest) RenderMode {
+	switch {
+	case r.Prerendered:
+		return RenderPrerendered
+	case r.Bot:
+		return RenderSSR
+	case r.Busy():
+		return RenderCSR
+	default:
+		return RenderSSR
+	}
+}
+
+// botAgents are lowercase User-Agent fragments of crawlers and link
+// previewers. Most crawlers name themselves bot, crawler or spider.
+var botAgents = []string{
+	"bot",
+	"crawler",
+	"spider",
+	"slurp",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"embedly",
+	"quora link preview",
+	"pinterest",
+	"vkshare",
+	"w3c_validator",
+	"whatsapp",
+	"lighthouse",
+	"chrome-lighthouse",
+	"google-inspectiontool",
+	"google-pagerenderer",
+	"headlesschrome",
+}
+
+// IsBot reports whether userAgent belongs to a crawler or link previewer.
+func IsBot(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, fragment := range botAgents {
+		if strings.Contains(ua, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide runs the render policy for c. page is the prerendered page for the
+// request, if any.
+func (a *ssrApp) decide(c *gin.Context, page []byte) RenderMode {
+	policy := a.opts.policy
+	if policy == nil {
+		policy = DefaultRenderPolicy
+	}
+	req := PolicyRequest{
+		Request:     c.Request,
+		Bot:         IsBot(c.Request.UserAgent()),
+		Prerendered: page != nil,
+		Renders:     int(a.renders.Load()),
+		RenderLimit: a.renderSlots(),
+	}
+
+	mode := policy(req)
+	switch mode {
+	case RenderSSR, RenderCSR:
+	case RenderPrerendered:
+		if page == nil {
+			mode = RenderSSR
+		}
+	default:
+		log.Printf("ssr policy returned unknown mode %q, rendering path=%s", mode, c.Request.URL.Path)
+		mode = RenderSSR
+	}
+
+	client := "human"
+	if req.Bot {
+		client = "bot"
+	}
+	renderDecisions.WithLabelValues(string(mode), client).Inc()
+	if mode == RenderCSR {
+		log.Printf("ssr policy app=%s path=%s client=%s mode=%s renders=%d limit=%d", a.name, c.Request.URL.Path, client, mode, req.Renders, req.RenderLimit)
+	}
+	return mode
+}
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDefaultRenderPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  PolicyRequest
+		want RenderMode
+	}{
+		{"idle", PolicyRequest{Renders: 1, RenderLimit: 4}, RenderSSR},
+		{"no limit", PolicyRequest{Renders: 100}, RenderSSR},
+		{"busy", PolicyRequest{Renders: 4, RenderLimit: 4}, RenderCSR},
+		{"busy bot", PolicyRequest{Bot: true, Renders: 4, RenderLimit: 4}, RenderSSR},
+		{"prerendered", PolicyRequest{Prerendered: true}, RenderPrerendered},
+		{"prerendered busy", PolicyRequest{Prerendered: true, Renders: 4, RenderLimit: 4}, RenderPrerendered},
+		{"prerendered bot", PolicyRequest{Prerendered: true, Bot: true}, RenderPrerendered},
+	} {
+		if got := DefaultRenderPolicy(tt.req); got != tt.want {
+			t.Errorf("%s: DefaultRenderPolicy = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsBot(t *testing.T) {
+	for _, tt := range []struct {
+		ua   string
+		want bool
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", true},
+		{"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"WhatsApp/2.23.20.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", true},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", false},
+		{"", false},
+	} {
+		if got := IsBot(tt.ua); got != tt.want {
+			t.Errorf("IsBot(%q) = %t, want %t", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func fallbackCount(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := renderFallbacks.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestCSRPolicySkipsRender(t *testing.T) {
+	var fetches atomic.Int32
+	fetcher := func(context.Context, *http.Request) (SSRPayload, error) {
+		fetches.Add(1)
+		return nil, nil
+	}
+	csr := func(PolicyRequest) RenderMode { return RenderCSR }
+
+	router := gin.New()
+	RunApps(router, App{
+		Name: "csr-policy",
+		Build: FrontendBuild{
+			FrontendDist: fstest.MapFS{"index.html": {Data: []byte(`<html><head></head><body><!--app-html--></body></html>`)}},
+			ServerDist:   fstest.MapFS{"server.js": {Data: []byte(`globalThis.ssrRender = (p) => "<i>rendered</i>"`)}},
+		},
+		Fetcher: fetcher,
+		Options: []RunOption{WithRenderPolicy(csr)},
+	})
+	t.Cleanup(func() { ssrApps.Delete("csr-policy") })
+
+	fallbacks := fallbackCount(t)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/en/about", nil))
+
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "rendered") || !strings.Contains(w.Body.String(), `<div id="app"></div>`) {
+		t.Fatalf("CSR response = %d:\n%s", w.Code, w.Body.String())
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("payload fetched %d times for the CSR shell", n)
+	}
+	if got := fallbackCount(t); got != fallbacks {
+		t.Errorf("render fallbacks went from %v to %v for the CSR shell", fallbacks, got)
+	}
+}
@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// prerenderIndex is the file a prerendered path is stored as, so /en/about
+// becomes en/about/index.html.
+const prerenderIndex = "index.html"
+
+// PrerenderOptions configures Prerender.
+type PrerenderOptions struct {
+	// Paths are the concrete URL paths to render.
+	Paths []string
+	// OutDir receives one index.html per path.
+	OutDir string
+	// Origin is the scheme and host pages are rendered for, such as
+	// https://example.com; it ends up in siteOrigin and absolute links.
+	Origin string
+}
+
+// WithPrerendered serves pages written by Prerender from fsys before
+// rendering. Without it they are served from SSR_PRERENDER_DIR, if set.
+func WithPrerendered(fsys fs.FS) RunOption {
+	return func(o *runOptions) {
+		o.prerendered = fsys
+	}
+}
+
+// Prerender renders opts.Paths through the fetcher and renderer the server
+// would use and writes the pages to opts.OutDir. Paths that redirect or are
+// not found are skipped; a path whose render fails does not stop the others
+// and is reported in the returned error. Pages are rendered through router,
+// whose NoRoute Prerender claims.
+func Prerender(ctx context.Context, router *gin.Engine, build FrontendBuild, fetcher BackendDataFetcher, opts PrerenderOptions, runOpts ...RunOption) error {
+	if opts.OutDir == "" {
+		return errors.New("prerender: no output directory")
+	}
+	origin, err := url.Parse(opts.Origin)
+	if opts.Origin != "" && (err != nil || origin.Host == "") {
+		return fmt.Errorf("prerender: invalid origin %q", opts.Origin)
+	}
+
+	app, err := newSSRApp(router, build, fetcher, newRunOptions(runOpts))
+	if err != nil {
+		return err
+	}
+	router.NoRoute(func(c *gin.Context) {
+		if !runLoopback(c) {
+			c.Status(http.StatusNotFound)
+		}
+	})
+	defer app.bundle.Load().retire()
+	// A build step waits for slow pages rather than falling back.
+	app.streaming = false
+
+	var errs []error
+	for _, p := range opts.Paths {
+		if err := app.prerender(ctx, p, origin, opts.OutDir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *ssrApp) prerender(ctx context.Context, urlPath string, origin *url.URL, outDir string) error {
+	name, ok := prerenderName(urlPath)
+	if !ok {
+		return errors.New("not a clean absolute path")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlPath, http.NoBody)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != "" {
+		req.Host = origin.Host
+		req.Header.Set("X-Forwarded-Proto", origin.Scheme)
+	}
+	fellBack := false
+	w, err := serveLoopback(a.router, req, func(c *gin.Context) {
+		a.serve(c)
+		fellBack = c.GetBool(noCacheKey)
+	})
+
+	switch {
+	case err != nil:
+		return err
+	case fellBack:
+		return errors.New("render failed, the page fell back to client-side rendering")
+	case w.Status() >= http.StatusInternalServerError:
+		return fmt.Errorf("responded with status %d", w.Status())
+	case w.Status() != http.StatusOK:
+		log.Printf("prerender skipped path=%s status=%d location=%q", urlPath, w.Status(), w.Header().Get("Location"))
+		return nil
+	}
+
+	file := filepath.Join(outDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, w.body.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	log.Printf("prerendered path=%s file=%s", urlPath, file)
+	return nil
+}
+
+// prerenderedPage returns the prerendered page for r, or nil if there is
+// none. Like the page cache, it only serves anonymous GET and HEAD requests;
+// requests with a query string are rendered as the query may change the page.
+func (a *ssrApp) prerenderedPage(r *http.Request) []byte {
+	if a.prerendered == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return nil
+	}
+	if r.URL.RawQuery != "" || sessionStateFromRequest(r) != nil {
+		return nil
+	}
+
+	name, ok := prerenderName(r.URL.Path)
+	if !ok {
+		return nil
+	}
+	page, err := fs.ReadFile(a.prerendered, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("prerendered page read failed path=%s err=%v", r.URL.Path, err)
+		}
+		return nil
+	}
+	return page
+}
+
+// prerenderName maps a URL path to its file in the prerender directory.
+func prerenderName(urlPath string) (string, bool) {
+	clean := path.Clean(urlPath)
+	if !strings.HasPrefix(urlPath, "/") || (urlPath != clean && urlPath != clean+"/") {
+		return "", false
+	}
+	name := path.Join(strings.TrimPrefix(clean, "/"), prerenderIndex)
+	return name, fs.ValidPath(name)
+}
+
+func prerenderedFromEnv() fs.FS {
+	dir := strings.TrimSpace(os.Getenv("SSR_PRERENDER_DIR"))
+	if dir == "" {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Printf("SSR_PRERENDER_DIR %q is not a directory; prerendered pages disabled", dir)
+		return nil
+	}
+	return os.DirFS(dir)
+}
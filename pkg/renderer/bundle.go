@@ -0,0 +1,132 @@
+package renderer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// moduleWrapperPrefix turns a CommonJS file into a function expression. It is
+// kept on its own line so stack positions only shift by one line.
+const moduleWrapperPrefix = "(function (exports, require, module, __filename, __dirname) {\n"
+
+// bundle is the server build: an entry script plus the chunks it requires,
+// read lazily from the server dist filesystem.
+type bundle struct {
+	fsys  fs.FS
+	entry string
+	hash  string
+
+	mu      sync.RWMutex
+	sources map[string]string
+	// maps holds the source map of each module, nil when it has none.
+	maps map[string]*sourceMap
+}
+
+func loadBundle(fsys fs.FS, entry string) (*bundle, error) {
+	entry = path.Clean(strings.TrimPrefix(entry, "/"))
+	if _, err := fs.Stat(fsys, entry); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundle{
+		fsys:    fsys,
+		entry:   entry,
+		hash:    hash,
+		sources: map[string]string{},
+		maps:    map[string]*sourceMap{},
+	}, nil
+}
+
+// hashFS fingerprints every file in the bundle, so a change to any chunk
+// invalidates caches keyed by it.
+func hashFS(fsys fs.FS) (string, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(data))
+		h.Write(data)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// source returns the module source wrapped as a CommonJS function expression.
+func (b *bundle) source(name string) (string, error) {
+	b.mu.RLock()
+	src, ok := b.sources[name]
+	b.mu.RUnlock()
+	if ok {
+		return src, nil
+	}
+
+	data, err := fs.ReadFile(b.fsys, name)
+	if err != nil {
+		return "", err
+	}
+
+	if path.Ext(name) == ".json" {
+		src = moduleWrapperPrefix + "module.exports = " + string(data) + "\n})"
+	} else {
+		src = moduleWrapperPrefix + string(data) + "\n})"
+	}
+
+	b.mu.Lock()
+	b.sources[name] = src
+	b.mu.Unlock()
+
+	return src, nil
+}
+
+// resolve maps a require() specifier to a file in the bundle. Only relative
+// specifiers are supported; the build is expected to inline dependencies.
+func (b *bundle) resolve(fromDir, spec string) (string, error) {
+	if !strings.HasPrefix(spec, "./") && !strings.HasPrefix(spec, "../") && !strings.HasPrefix(spec, "/") {
+		return "", fmt.Errorf("cannot find module '%s': only relative requires are supported", spec)
+	}
+
+	base := path.Join("/", fromDir, spec)
+	if strings.HasPrefix(spec, "/") {
+		base = path.Clean(spec)
+	}
+	base = strings.TrimPrefix(base, "/")
+	if base == "" {
+		return "", fmt.Errorf("cannot find module '%s'", spec)
+	}
+
+	for _, candidate := range []string{base, base + ".js", base + ".cjs", base + ".json", path.Join(base, "index.js")} {
+		if info, err := fs.Stat(b.fsys, candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot find module '%s' from '%s'", spec, fromDir)
+}
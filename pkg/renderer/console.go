@@ -0,0 +1,77 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"log/slog"
+	"strings"
+
+	"rogchap.com/v8go"
+)
+
+// installConsole builds a console template whose methods forward to xlog,
+// tagged with the path and request ID of the render in progress.
+func installConsole(c *IsolateContainer) error {
+	console := v8go.NewObjectTemplate(c.Isolate)
+
+	for method, level := range consoleLevels {
+		fn := v8go.NewFunctionTemplate(c.Isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+			logConsoleLine(c.state, level, info)
+			return nil
+		})
+		if err := console.Set(method, fn); err != nil {
+			return err
+		}
+	}
+
+	noop := v8go.NewFunctionTemplate(c.Isolate, func(*v8go.FunctionCallbackInfo) *v8go.Value {
+		return nil
+	})
+	for _, method := range consoleNoops {
+		if err := console.Set(method, noop); err != nil {
+			return err
+		}
+	}
+
+	c.console = console
+	return nil
+}
+
+// bindConsole replaces V8's built-in console, which discards output when no
+// inspector is attached, with an instance of the Go-backed template.
+func bindConsole(ctx *v8go.Context, c *IsolateContainer) error {
+	if c.console == nil {
+		return nil
+	}
+
+	console, err := c.console.NewInstance(ctx)
+	if err != nil {
+		return err
+	}
+	return ctx.Global().Set("console", console)
+}
+
+func logConsoleLine(state *renderState, level slog.Level, info *v8go.FunctionCallbackInfo) {
+	if state == nil || !state.console.allow() {
+		return
+	}
+
+	parts := make([]string, 0, len(info.Args()))
+	for _, arg := range info.Args() {
+		parts = append(parts, formatConsoleArg(info.Context(), arg))
+	}
+	state.console.write(level, strings.Join(parts, " "))
+}
+
+func formatConsoleArg(ctx *v8go.Context, arg *v8go.Value) string {
+	if arg.IsString() || !arg.IsObject() {
+		return arg.String()
+	}
+	if arg.IsNativeError() {
+		return errorStack(arg)
+	}
+	if s, err := v8go.JSONStringify(ctx, arg); err == nil {
+		return s
+	}
+	return arg.String()
+}
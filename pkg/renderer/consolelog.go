@@ -0,0 +1,73 @@
+package renderer
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/daodao97/xgo/xlog"
+)
+
+const (
+	defaultConsoleMaxLines = 100
+	consoleMaxLineBytes    = 4096
+)
+
+var consoleLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"trace": slog.LevelDebug,
+	"log":   slog.LevelInfo,
+	"info":  slog.LevelInfo,
+	"dir":   slog.LevelInfo,
+	"table": slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// consoleNoops keep libraries that group or time their output from throwing.
+var consoleNoops = []string{
+	"assert", "clear", "count", "countReset", "group", "groupCollapsed",
+	"groupEnd", "time", "timeEnd", "timeLog", "timeStamp",
+}
+
+// consoleLog writes the console output of one render to xlog, tagged with
+// the path and request ID of the render.
+type consoleLog struct {
+	ctx       context.Context
+	path      string
+	requestID string
+	// bundle maps stack positions in logged errors.
+	bundle *bundle
+
+	lines    int
+	maxLines int
+}
+
+// allow counts a line and reports whether it is within the limit. The first
+// line over it logs a warning instead.
+func (l *consoleLog) allow() bool {
+	l.lines++
+	if l.lines <= l.maxLines {
+		return true
+	}
+	if l.lines == l.maxLines+1 {
+		xlog.WarnCtx(l.ctx, "ssr console output truncated",
+			xlog.String("path", l.path),
+			xlog.String("request_id", l.requestID),
+			xlog.Int("max_lines", l.maxLines),
+		)
+	}
+	return false
+}
+
+func (l *consoleLog) write(level slog.Level, line string) {
+	line = l.bundle.mapStack(line)
+	if len(line) > consoleMaxLineBytes {
+		line = line[:consoleMaxLineBytes] + "…"
+	}
+
+	xlog.GetLogger().Log(l.ctx, level, "ssr console",
+		xlog.String("path", l.path),
+		xlog.String("request_id", l.requestID),
+		xlog.String("line", line),
+	)
+}
@@ -0,0 +1,99 @@
+package renderer
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type (
+	requestIDKey   struct{}
+	requestKey     struct{}
+	requestInfoKey struct{}
+)
+
+// WithRequestID attaches the request ID that SSR logs are tagged with.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID set by WithRequestID.
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithRequest attaches the incoming request a render serves. fetch() inside
+// the render resolves URLs against it and forwards its cookies.
+func WithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// RequestFromContext returns the request set by WithRequest.
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// WithRequestInfo attaches the request descriptor a render exposes to
+// server.js as __SSR_REQUEST__. Without it, __SSR_REQUEST__ is undefined.
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the descriptor set by WithRequestInfo.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// Priority orders renders waiting for a render worker; see WithWorkers.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+type priorityKey struct{}
+
+// WithPriority sets the priority a render waits for a worker with. Renders
+// without one have PriorityNormal. NodeRenderer ignores it.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority set by WithPriority.
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+type queueBudgetKey struct{}
+
+// WithQueueBudget caps how long a render waits for a worker, apart from its
+// deadline; a render still queued after d fails with ErrQueueBudget.
+// Renderers without workers and NodeRenderer ignore it.
+func WithQueueBudget(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queueBudgetKey{}, d)
+}
+
+// QueueBudgetFromContext returns the budget set by WithQueueBudget, or 0.
+func QueueBudgetFromContext(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(queueBudgetKey{}).(time.Duration)
+	return d
+}
+
+func (p Priority) String() string {
+	switch {
+	case p < PriorityNormal:
+		return "low"
+	case p > PriorityNormal:
+		return "high"
+	default:
+		return "normal"
+	}
+}
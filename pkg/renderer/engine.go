@@ -0,0 +1,91 @@
+package renderer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrRenderPanic fails a render during which a Go callback panicked. The
+// isolate it ran on is discarded.
+var ErrRenderPanic = errors.New("render panicked")
+
+// ErrQueueBudget fails a render that waited for a render worker longer than
+// the budget set with WithQueueBudget.
+var ErrQueueBudget = errors.New("render queue wait exceeded the budget")
+
+// ErrQueueWait fails a render whose context ended while it waited for a
+// render worker or an isolate, before server.js ran. It wraps the context
+// error.
+var ErrQueueWait = errors.New("render aborted while waiting to start")
+
+// Engine renders server.js. *Renderer runs it in embedded V8 isolates and
+// needs cgo; *NodeRenderer runs it in a supervised Node.js process.
+type Engine interface {
+	// Render renders urlPath with payload as __SSR_DATA__ and the
+	// RequestInfo attached to ctx, if any, as __SSR_REQUEST__.
+	Render(ctx context.Context, urlPath string, payload map[string]any) (Result, error)
+	// RenderStream renders like Render but hands HTML to w as it is
+	// produced; see Renderer.RenderStream.
+	RenderStream(ctx context.Context, urlPath string, payload map[string]any, w StreamWriter) (Result, error)
+	// BundleHash fingerprints the server bundle being rendered.
+	BundleHash() string
+	// Close stops the engine once renders in progress have returned.
+	Close()
+}
+
+type Result struct {
+	HTML string
+	// Head holds tags for the end of <head>.
+	Head string
+	// HTMLAttrs and BodyAttrs are merged into the <html> and <body> tags;
+	// class values are added to the existing ones.
+	HTMLAttrs map[string]string
+	BodyAttrs map[string]string
+	// BodyEnd holds markup for the end of <body>, e.g. teleports to body.
+	BodyEnd string
+
+	// Status is the HTTP status server.js set, or 0 to keep the default.
+	Status int
+	// Location is the redirect target server.js set; Status is then 3xx.
+	Location string
+	// Header holds extra response headers set by server.js.
+	Header http.Header
+	// Cookies holds raw Set-Cookie values set by server.js.
+	Cookies []string
+
+	// State is the application state server.js left in
+	// globalThis.__SSR_STATE__ after rendering, for the client to hydrate.
+	State map[string]any
+}
+
+// StreamWriter receives the output of a streaming render.
+type StreamWriter interface {
+	// WriteHead is called once, right before the first chunk, with the head
+	// content, html and body attributes and response metadata server.js had
+	// set by then. A redirect arrives here too, and the chunks written after
+	// it may be dropped.
+	WriteHead(res Result) error
+	// WriteChunk is called for every piece of rendered HTML.
+	WriteChunk(chunk string) error
+}
+
+// appStateScript serializes globalThis.__SSR_STATE__, or yields null when
+// server.js did not set an object.
+const appStateScript = `(s => s && typeof s === 'object' && !Array.isArray(s) ? JSON.stringify(s) : null)(globalThis.__SSR_STATE__)`
+
+// parseAppState decodes the output of appStateScript. Numbers are kept as
+// json.Number so large IDs survive the round trip to the page.
+func parseAppState(raw string) (map[string]any, error) {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+
+	var appState map[string]any
+	if err := dec.Decode(&appState); err != nil {
+		return nil, fmt.Errorf("invalid __SSR_STATE__: %w", err)
+	}
+	return appState, nil
+}
@@ -0,0 +1,190 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/daodao97/xgo/xlog"
+	"rogchap.com/v8go"
+)
+
+// minTimerInterval mirrors the browser clamp for repeating timers so a
+// setInterval(fn, 0) cannot spin the loop.
+const minTimerInterval = 4 * time.Millisecond
+
+// maxTimerDelay is the longest delay browsers keep, 2^31-1 milliseconds.
+// Longer delays are capped to it.
+const maxTimerDelay = math.MaxInt32 * time.Millisecond
+
+// eventLoop drives the timers scheduled during one render and settles the
+// promises of async Go functions. It only runs while the render promise is
+// pending and is stopped when the render ends.
+type eventLoop struct {
+	nextID int32
+	seq    uint64
+	timers map[int32]*timer
+
+	// calls delivers the results of async Go functions; pending counts
+	// those still running.
+	calls   chan hostCall
+	pending int
+	quit    chan struct{}
+}
+
+// hostCall is the result of an async Go function for the promise it
+// settles.
+type hostCall struct {
+	resolver *v8go.PromiseResolver
+	result   string
+	err      error
+}
+
+type timer struct {
+	fn       *v8go.Function
+	due      time.Time
+	interval time.Duration
+	seq      uint64
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{
+		timers: map[int32]*timer{},
+		calls:  make(chan hostCall),
+		quit:   make(chan struct{}),
+	}
+}
+
+// goCall runs fn on its own goroutine; runNext settles resolver with its
+// result on the render goroutine.
+func (l *eventLoop) goCall(resolver *v8go.PromiseResolver, fn func() (string, error)) {
+	l.pending++
+	go func() {
+		call := hostCall{resolver: resolver}
+		call.result, call.err = fn()
+		select {
+		case l.calls <- call:
+		case <-l.quit:
+		}
+	}()
+}
+
+// stop releases the goroutines of async calls the render did not wait for.
+func (l *eventLoop) stop() {
+	close(l.quit)
+}
+
+// timerDelay converts a delay in milliseconds given to setTimeout into a
+// duration. NaN and negative delays run on the next turn; longer delays
+// than maxTimerDelay, Infinity included, are capped to it.
+func timerDelay(ms float64) time.Duration {
+	switch {
+	case math.IsNaN(ms) || ms <= 0:
+		return 0
+	case ms >= float64(maxTimerDelay/time.Millisecond):
+		return maxTimerDelay
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (l *eventLoop) setTimer(fn *v8go.Function, delay time.Duration, repeat bool) int32 {
+	if delay < 0 {
+		delay = 0
+	}
+
+	l.nextID++
+	l.seq++
+	t := &timer{
+		fn:  fn,
+		due: time.Now().Add(delay),
+		seq: l.seq,
+	}
+	if repeat {
+		t.interval = max(delay, minTimerInterval)
+	}
+	l.timers[l.nextID] = t
+
+	return l.nextID
+}
+
+func (l *eventLoop) clearTimer(id int32) {
+	delete(l.timers, id)
+}
+
+// runNext waits for the earliest timer or async call and runs its callback.
+// It reports false when no timers are scheduled and no calls are running,
+// i.e. nothing can make further progress.
+func (l *eventLoop) runNext(ctx context.Context, v8ctx *v8go.Context, state *renderState) (bool, error) {
+	var (
+		nextID int32
+		next   *timer
+	)
+	for id, t := range l.timers {
+		if next == nil || t.due.Before(next.due) || (t.due.Equal(next.due) && t.seq < next.seq) {
+			nextID, next = id, t
+		}
+	}
+	if next == nil && l.pending == 0 {
+		return false, nil
+	}
+
+	var due <-chan time.Time
+	if next != nil {
+		if wait := time.Until(next.due); wait > 0 {
+			t := time.NewTimer(wait)
+			defer t.Stop()
+			due = t.C
+		} else {
+			return true, l.runTimer(ctx, v8ctx, state, nextID, next)
+		}
+	}
+	select {
+	case <-due:
+		return true, l.runTimer(ctx, v8ctx, state, nextID, next)
+	case call := <-l.calls:
+		l.pending--
+		return true, l.settle(v8ctx, call)
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// runTimer runs the callback of timer id, which is due.
+func (l *eventLoop) runTimer(ctx context.Context, v8ctx *v8go.Context, state *renderState, id int32, t *timer) error {
+	if t.interval > 0 {
+		l.seq++
+		t.due = time.Now().Add(t.interval)
+		t.seq = l.seq
+	} else {
+		delete(l.timers, id)
+	}
+
+	iso := v8ctx.Isolate()
+	if _, err := t.fn.Call(v8go.Undefined(iso)); err != nil {
+		if ctx.Err() != nil || iso.IsExecutionTerminating() {
+			return err
+		}
+		xlog.WarnCtx(ctx, "ssr timer callback failed",
+			xlog.String("path", state.path),
+			xlog.String("request_id", state.requestID),
+			xlog.Any("err", state.bundle.mapError(formatError(err))),
+		)
+	}
+	return nil
+}
+
+// settle resolves or rejects the promise of an async Go function.
+func (l *eventLoop) settle(v8ctx *v8go.Context, call hostCall) error {
+	if call.err != nil {
+		call.resolver.Reject(newJSError(v8ctx, call.err))
+		return nil
+	}
+	val, err := v8go.NewValue(v8ctx.Isolate(), call.result)
+	if err != nil {
+		return err
+	}
+	call.resolver.Resolve(val)
+	return nil
+}
@@ -0,0 +1,225 @@
+package renderer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FetchHeader marks requests issued by fetch() inside a render. Handlers that
+// render pages should refuse them to avoid rendering recursively.
+const FetchHeader = "X-SSR-Internal"
+
+const (
+	defaultFetchMaxRequests     = 16
+	defaultFetchMaxResponseSize = 4 << 20
+)
+
+// FetchOptions controls the in-process fetch() exposed to server.js.
+type FetchOptions struct {
+	// AllowedPrefixes lists the path prefixes fetch may reach. Defaults to
+	// /api/ and /__ssr_fetch/.
+	AllowedPrefixes []string
+	// MaxRequests caps fetch calls per render.
+	MaxRequests int
+	// MaxResponseBytes caps the body size handed back to JS.
+	MaxResponseBytes int
+	// Header is added to every request, e.g. a shared token.
+	Header http.Header
+}
+
+type fetchRequest struct {
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers [][2]string `json:"headers"`
+	Body    *string     `json:"body"`
+}
+
+type fetchResponse struct {
+	URL        string      `json:"url,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	StatusText string      `json:"statusText,omitempty"`
+	Headers    [][2]string `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func (o FetchOptions) withDefaults() FetchOptions {
+	if len(o.AllowedPrefixes) == 0 {
+		o.AllowedPrefixes = []string{"/api/", "/__ssr_fetch/"}
+	}
+	if o.MaxRequests <= 0 {
+		o.MaxRequests = defaultFetchMaxRequests
+	}
+	if o.MaxResponseBytes <= 0 {
+		o.MaxResponseBytes = defaultFetchMaxResponseSize
+	}
+	return o
+}
+
+// serveFetch serves a fetch() call of the render for origin with handler.
+// Requests never leave the process.
+func serveFetch(ctx context.Context, origin *http.Request, handler http.Handler, opts FetchOptions, in fetchRequest) fetchResponse {
+	target, err := resolveFetchURL(origin, in.URL)
+	if err != nil {
+		return fetchResponse{Error: err.Error()}
+	}
+	if !fetchAllowed(opts.AllowedPrefixes, path.Clean("/"+target.Path)) {
+		return fetchResponse{Error: fmt.Sprintf("fetch %s is not allowed during SSR", target.Path)}
+	}
+
+	method := strings.ToUpper(in.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader = http.NoBody
+	if in.Body != nil {
+		body = strings.NewReader(*in.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.RequestURI(), body)
+	if err != nil {
+		return fetchResponse{Error: err.Error()}
+	}
+	for _, h := range in.Headers {
+		req.Header.Add(h[0], h[1])
+	}
+	for name, values := range opts.Header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req.Header.Del("Cookie")
+	if origin != nil {
+		req.Host = origin.Host
+		req.RemoteAddr = origin.RemoteAddr
+		for _, cookie := range origin.Cookies() {
+			req.AddCookie(cookie)
+		}
+		if lang := origin.Header.Get("Accept-Language"); lang != "" && req.Header.Get("Accept-Language") == "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+	}
+	req.Header.Set("X-SSR-Fetch", "1")
+	req.Header.Set(FetchHeader, "1")
+
+	w := newFetchWriter(opts.MaxResponseBytes)
+	start := time.Now()
+	handler.ServeHTTP(w, req)
+	fetchDuration.WithLabelValues(strconv.Itoa(w.Status())).Observe(time.Since(start).Seconds())
+
+	if w.overflow {
+		return fetchResponse{Error: fmt.Sprintf("fetch %s response exceeds %d bytes", target.Path, opts.MaxResponseBytes)}
+	}
+
+	res := fetchResponse{
+		URL:        target.String(),
+		Status:     w.Status(),
+		StatusText: http.StatusText(w.Status()),
+		Body:       strings.ToValidUTF8(w.body.String(), "\uFFFD"),
+	}
+	for name, values := range w.header {
+		for _, value := range values {
+			res.Headers = append(res.Headers, [2]string{strings.ToLower(name), value})
+		}
+	}
+
+	return res
+}
+
+// errFetchTooLarge is returned to handlers that write past the fetch budget.
+var errFetchTooLarge = errors.New("ssr fetch response too large")
+
+// fetchWriter buffers the response to a fetch() call and stops at limit
+// bytes, so a large response cannot grow the buffer past the budget.
+type fetchWriter struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func newFetchWriter(limit int) *fetchWriter {
+	return &fetchWriter{header: http.Header{}, limit: limit}
+}
+
+func (w *fetchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fetchWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *fetchWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.overflow {
+		return 0, errFetchTooLarge
+	}
+	if room := w.limit - w.body.Len(); len(b) > room {
+		w.body.Write(b[:room])
+		w.overflow = true
+		return room, errFetchTooLarge
+	}
+	return w.body.Write(b)
+}
+
+// Flush does nothing; gin requires an http.Flusher to stream responses.
+func (w *fetchWriter) Flush() {}
+
+// Status returns the response status, 200 if none was written.
+func (w *fetchWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// resolveFetchURL resolves raw against the incoming request and rejects
+// anything that is not same-origin.
+func resolveFetchURL(origin *http.Request, raw string) (*url.URL, error) {
+	base := &url.URL{Scheme: "http", Host: "localhost", Path: "/"}
+	if origin != nil {
+		base.Host = origin.Host
+		if origin.TLS != nil {
+			base.Scheme = "https"
+		}
+		if proto := origin.Header.Get("X-Forwarded-Proto"); proto != "" {
+			base.Scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+	}
+
+	target, err := base.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fetch url %q: %w", raw, err)
+	}
+	if !strings.EqualFold(target.Host, base.Host) {
+		return nil, fmt.Errorf("fetch %s is not same-origin", target.Redacted())
+	}
+
+	return target, nil
+}
+
+func fetchAllowed(prefixes []string, p string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(p, prefix) || p == strings.TrimSuffix(prefix, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchBudgetError reports a render that exceeded opts.MaxRequests.
+func fetchBudgetError(opts FetchOptions) fetchResponse {
+	return fetchResponse{Error: fmt.Sprintf("fetch budget of %d requests per render exceeded", opts.MaxRequests)}
+}
@@ -0,0 +1,144 @@
+// fetch() for SSR contexts. Requests are handed to Go and served in-process;
+// the returned promise settles synchronously from the caller's perspective.
+(function (host) {
+  'use strict'
+
+  if (typeof host.fetch !== 'function')
+    return
+
+  const g = globalThis
+
+  function define(name, value) {
+    Object.defineProperty(g, name, { value, writable: true, configurable: true, enumerable: false })
+  }
+
+  class Headers {
+    #map = new Map()
+
+    constructor(init) {
+      if (init instanceof Headers) {
+        init.forEach((value, name) => this.append(name, value))
+      }
+      else if (Array.isArray(init)) {
+        for (const [name, value] of init)
+          this.append(name, value)
+      }
+      else if (init && typeof init === 'object') {
+        for (const name of Object.keys(init))
+          this.append(name, init[name])
+      }
+    }
+
+    append(name, value) {
+      const key = String(name).toLowerCase()
+      const prev = this.#map.get(key)
+      this.#map.set(key, prev === undefined ? String(value) : `${prev}, ${value}`)
+    }
+
+    set(name, value) { this.#map.set(String(name).toLowerCase(), String(value)) }
+    get(name) { return this.#map.get(String(name).toLowerCase()) ?? null }
+    has(name) { return this.#map.has(String(name).toLowerCase()) }
+    delete(name) { this.#map.delete(String(name).toLowerCase()) }
+
+    forEach(callback, thisArg) {
+      for (const [name, value] of this.#map)
+        callback.call(thisArg, value, name, this)
+    }
+
+    * keys() { yield * this.#map.keys() }
+    * values() { yield * this.#map.values() }
+    * entries() { yield * this.#map.entries() }
+    [Symbol.iterator]() { return this.entries() }
+  }
+
+  class Response {
+    #body
+    #used = false
+
+    constructor(body = '', init = {}) {
+      this.#body = body === null || body === undefined ? '' : String(body)
+      this.status = init.status ?? 200
+      this.statusText = init.statusText ?? ''
+      this.headers = new Headers(init.headers)
+      this.url = init.url ?? ''
+      this.type = 'basic'
+      this.redirected = false
+    }
+
+    get ok() { return this.status >= 200 && this.status < 300 }
+    get bodyUsed() { return this.#used }
+
+    #consume() {
+      if (this.#used)
+        return Promise.reject(new TypeError('Body has already been consumed'))
+      this.#used = true
+      return Promise.resolve(this.#body)
+    }
+
+    text() { return this.#consume() }
+    json() { return this.#consume().then(text => JSON.parse(text)) }
+
+    arrayBuffer() {
+      return this.#consume().then((text) => {
+        if (typeof g.TextEncoder !== 'function')
+          throw new TypeError('arrayBuffer() requires the TextEncoder polyfill')
+        return new g.TextEncoder().encode(text).buffer
+      })
+    }
+
+    clone() {
+      if (this.#used)
+        throw new TypeError('Response body is already used')
+      return new Response(this.#body, this)
+    }
+  }
+
+  function serializeBody(body, headers) {
+    if (body === undefined || body === null)
+      return null
+    if (typeof g.URLSearchParams === 'function' && body instanceof g.URLSearchParams) {
+      if (!headers.has('content-type'))
+        headers.set('content-type', 'application/x-www-form-urlencoded;charset=UTF-8')
+      return body.toString()
+    }
+    if (typeof body !== 'string')
+      throw new TypeError('SSR fetch only supports string and URLSearchParams bodies')
+    if (!headers.has('content-type'))
+      headers.set('content-type', 'text/plain;charset=UTF-8')
+    return body
+  }
+
+  function fetch(input, init = {}) {
+    try {
+      const url = typeof input === 'string' ? input : (input && (input.href ?? input.url)) ?? String(input)
+      const headers = new Headers(init.headers ?? (input && input.headers))
+      const method = String(init.method ?? (input && input.method) ?? 'GET').toUpperCase()
+      const body = serializeBody(init.body, headers)
+
+      const res = JSON.parse(host.fetch(JSON.stringify({
+        url: String(url),
+        method,
+        headers: Array.from(headers.entries()),
+        body,
+      })))
+      if (res.error)
+        return Promise.reject(new TypeError(res.error))
+
+      return Promise.resolve(new Response(res.body, {
+        status: res.status,
+        statusText: res.statusText,
+        headers: res.headers,
+        url: res.url,
+      }))
+    }
+    catch (err) {
+      return Promise.reject(err)
+    }
+  }
+
+  define('fetch', fetch)
+  if (typeof g.Headers === 'undefined')
+    define('Headers', Headers)
+  if (typeof g.Response === 'undefined')
+    define('Response', Response)
+})
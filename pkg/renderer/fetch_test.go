@@ -0,0 +1,88 @@
+package renderer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func fetchOrigin() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/page", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	return r
+}
+
+func TestServeFetchAllowlist(t *testing.T) {
+	served := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true })
+	opts := FetchOptions{}.withDefaults()
+
+	for _, url := range []string{"/admin/users", "/api/../admin", "https://other.example.com/api/x"} {
+		res := serveFetch(context.Background(), fetchOrigin(), handler, opts, fetchRequest{URL: url})
+		if res.Error == "" {
+			t.Errorf("fetch %s = %d, want an error", url, res.Status)
+		}
+	}
+	if served {
+		t.Fatal("a rejected fetch reached the handler")
+	}
+
+	res := serveFetch(context.Background(), fetchOrigin(), handler, opts, fetchRequest{URL: "/api/x"})
+	if res.Error != "" || res.Status != http.StatusOK || !served {
+		t.Fatalf("fetch /api/x = %+v, want it served", res)
+	}
+}
+
+func TestServeFetchHeaders(t *testing.T) {
+	var got *http.Request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r })
+	in := fetchRequest{URL: "/api/me", Headers: [][2]string{{"Cookie", "forged=1"}}}
+
+	serveFetch(context.Background(), fetchOrigin(), handler, FetchOptions{}.withDefaults(), in)
+	if got == nil {
+		t.Fatal("fetch did not reach the handler")
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "session=abc" {
+		t.Errorf("Cookie = %q, want the cookies of the page request only", cookie)
+	}
+	if got.Host != "example.com" {
+		t.Errorf("Host = %q, want the host of the page request", got.Host)
+	}
+	// The loop guards that keep page handlers from rendering fetches.
+	if got.Header.Get("X-SSR-Fetch") != "1" || got.Header.Get(FetchHeader) != "1" {
+		t.Errorf("fetch headers = %v, want X-SSR-Fetch and %s set", got.Header, FetchHeader)
+	}
+}
+
+func TestServeFetchResponseBudget(t *testing.T) {
+	written := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 1024))
+		for i := 0; i < 64; i++ {
+			n, err := w.Write(chunk)
+			written += n
+			if err != nil {
+				return
+			}
+		}
+	})
+	opts := FetchOptions{MaxResponseBytes: 4096}.withDefaults()
+
+	res := serveFetch(context.Background(), fetchOrigin(), handler, opts, fetchRequest{URL: "/api/big"})
+	if !strings.Contains(res.Error, "exceeds 4096 bytes") {
+		t.Fatalf("fetch past the budget = %+v, want a size error", res)
+	}
+	if written != 4096 {
+		t.Fatalf("handler wrote %d bytes, want the writer to stop at 4096", written)
+	}
+
+	res = serveFetch(context.Background(), fetchOrigin(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}), opts, fetchRequest{URL: "/api/exact"})
+	if res.Error != "" || res.Status != http.StatusTeapot || len(res.Body) != 4096 {
+		t.Fatalf("fetch at the budget = %d, %d bytes, %q", res.Status, len(res.Body), res.Error)
+	}
+}
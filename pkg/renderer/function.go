@@ -0,0 +1,203 @@
+package renderer
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+//go:embed function.js
+var functionPrelude string
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+	jsIdent     = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+)
+
+// functions holds the Go functions registered for server.js.
+var functions struct {
+	sync.Mutex
+	byName map[string]*hostFunction
+}
+
+// RegisterFunction makes fn a global function of every render context
+// created by renderers started afterwards, e.g. for translation lookups or
+// feature flags that server.js only knows it needs while rendering.
+//
+// fn may take a context.Context first, which is the render's context, and
+// then any arguments encoding/json can decode. It may return a value
+// encoding/json can encode, an error, or both. Arguments and the return
+// value are converted through JSON; missing arguments are zero values. A
+// returned error is thrown in JS. fn runs on the render's goroutine and
+// blocks the render, so it must be quick; see RegisterAsyncFunction.
+//
+// RegisterFunction panics if name is not a JavaScript identifier, is
+// already registered, or fn does not have a supported signature.
+func RegisterFunction(name string, fn any) {
+	register(name, fn, false)
+}
+
+// RegisterAsyncFunction is like RegisterFunction, but the JS function
+// returns a promise and fn runs on its own goroutine, so slow calls such as
+// signing URLs with a remote key service do not block the render. A
+// returned error rejects the promise. fn should honour the cancellation of
+// its context.
+func RegisterAsyncFunction(name string, fn any) {
+	register(name, fn, true)
+}
+
+func register(name string, fn any, async bool) {
+	f, err := newHostFunction(name, fn, async)
+	if err != nil {
+		panic(fmt.Sprintf("renderer: register function %q: %v", name, err))
+	}
+
+	functions.Lock()
+	defer functions.Unlock()
+	if _, ok := functions.byName[name]; ok {
+		panic(fmt.Sprintf("renderer: function %q registered twice", name))
+	}
+	if functions.byName == nil {
+		functions.byName = map[string]*hostFunction{}
+	}
+	functions.byName[name] = f
+}
+
+// registeredFunctions returns the registered functions by name. Renderers
+// keep the set they started with.
+func registeredFunctions() map[string]*hostFunction {
+	functions.Lock()
+	defer functions.Unlock()
+	out := make(map[string]*hostFunction, len(functions.byName))
+	for name, f := range functions.byName {
+		out[name] = f
+	}
+	return out
+}
+
+// functionList describes fns to function.js as JSON.
+func functionList(fns map[string]*hostFunction) string {
+	type entry struct {
+		Name  string `json:"name"`
+		Async bool   `json:"async"`
+	}
+	list := make([]entry, 0, len(fns))
+	for _, f := range fns {
+		list = append(list, entry{Name: f.name, Async: f.async})
+	}
+	slices.SortFunc(list, func(a, b entry) int { return strings.Compare(a.Name, b.Name) })
+	raw, _ := json.Marshal(list)
+	return string(raw)
+}
+
+// hostFunction is a registered Go function and its signature.
+type hostFunction struct {
+	name  string
+	async bool
+	fn    reflect.Value
+	// withContext is set when fn takes a context.Context first.
+	withContext bool
+	args        []reflect.Type
+	// result and withError say what fn returns.
+	result    bool
+	withError bool
+}
+
+func newHostFunction(name string, fn any, async bool) (*hostFunction, error) {
+	if !jsIdent.MatchString(name) {
+		return nil, errors.New("name is not a JavaScript identifier")
+	}
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, errors.New("not a function")
+	}
+	t := v.Type()
+	if t.IsVariadic() {
+		return nil, errors.New("variadic functions are not supported")
+	}
+
+	f := &hostFunction{name: name, async: async, fn: v}
+	for i := range t.NumIn() {
+		in := t.In(i)
+		if i == 0 && in == contextType {
+			f.withContext = true
+			continue
+		}
+		f.args = append(f.args, in)
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) == errorType {
+			f.withError = true
+		} else {
+			f.result = true
+		}
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, errors.New("the second result must be an error")
+		}
+		f.result, f.withError = true, true
+	default:
+		return nil, errors.New("too many results")
+	}
+	return f, nil
+}
+
+// call decodes the JSON array of arguments rawArgs, calls the function and
+// returns its result as JSON, or "" when it returns no value.
+func (f *hostFunction) call(ctx context.Context, rawArgs string) (result string, err error) {
+	var raw []json.RawMessage
+	if rawArgs != "" {
+		if err := json.Unmarshal([]byte(rawArgs), &raw); err != nil {
+			return "", fmt.Errorf("%s: invalid arguments: %w", f.name, err)
+		}
+	}
+	if len(raw) > len(f.args) {
+		return "", fmt.Errorf("%s takes %d arguments, got %d", f.name, len(f.args), len(raw))
+	}
+
+	in := make([]reflect.Value, 0, len(f.args)+1)
+	if f.withContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	for i, t := range f.args {
+		arg := reflect.New(t)
+		if i < len(raw) {
+			if err := json.Unmarshal(raw[i], arg.Interface()); err != nil {
+				return "", fmt.Errorf("%s: argument %d: %w", f.name, i+1, err)
+			}
+		}
+		in = append(in, arg.Elem())
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s panicked: %v", f.name, p)
+		}
+	}()
+	out := f.fn.Call(in)
+
+	if f.withError {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return "", err
+		}
+	}
+	if !f.result {
+		return "", nil
+	}
+	encoded, err := json.Marshal(out[0].Interface())
+	if err != nil {
+		return "", fmt.Errorf("%s: encode result: %w", f.name, err)
+	}
+	return string(encoded), nil
+}
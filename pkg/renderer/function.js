@@ -0,0 +1,18 @@
+// Globals for the Go functions registered with RegisterFunction and
+// RegisterAsyncFunction. Arguments and results cross to Go as JSON; Go
+// errors are thrown, or reject the promise of an async function.
+(function (host) {
+  'use strict'
+
+  if (typeof host.callFunction !== 'function')
+    return
+
+  const decode = raw => raw === '' ? undefined : JSON.parse(raw)
+
+  for (const { name, async } of JSON.parse(host.functions)) {
+    const fn = async
+      ? (...args) => host.callAsyncFunction(name, JSON.stringify(args)).then(decode)
+      : (...args) => decode(host.callFunction(name, JSON.stringify(args)))
+    Object.defineProperty(globalThis, name, { value: fn, writable: true, configurable: true, enumerable: false })
+  }
+})
@@ -0,0 +1,72 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var registerTestFunctions = sync.OnceFunc(func() {
+	RegisterFunction("testGreet", func(ctx context.Context, name string) string {
+		return "hello " + name + " from " + RequestIDFromContext(ctx)
+	})
+	RegisterFunction("testFail", func() (int, error) { return 0, errors.New("lookup failed") })
+	RegisterAsyncFunction("testSign", func(ctx context.Context, url string) (string, error) {
+		if url == "" {
+			return "", errors.New("nothing to sign")
+		}
+		return url + "?sig=1", nil
+	})
+})
+
+func TestRegisteredFunctions(t *testing.T) {
+	registerTestFunctions()
+	r, err := NewRenderer(serverBundle(`globalThis.ssrRender = async () => {
+  const out = [testGreet("js")]
+  try { testFail() } catch (err) { out.push("thrown: " + err.message) }
+  out.push(await testSign("/a"))
+  await testSign("").catch((err) => out.push("rejected: " + err.message))
+  try { testMissing() } catch (err) { out.push(err.name) }
+  return out.join("|")
+}`), "server.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+
+	res, err := r.Render(WithRequestID(context.Background(), "req-1"), "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello js from req-1|thrown: lookup failed|/a?sig=1|rejected: nothing to sign|ReferenceError"
+	if res.HTML != want {
+		t.Fatalf("calls = %q, want %q", res.HTML, want)
+	}
+}
+
+func TestRegisterFunctionRejects(t *testing.T) {
+	registerTestFunctions()
+	for _, tt := range []struct {
+		name string
+		fn   any
+		want string
+	}{
+		{"testGreet", func() {}, "registered twice"},
+		{"not-an-identifier", func() {}, "not a JavaScript identifier"},
+		{"testNotFunc", 42, "not a function"},
+		{"testBadResult", func() (int, int) { return 0, 0 }, "second result must be an error"},
+	} {
+		func() {
+			defer func() {
+				if p := recover(); p == nil || !strings.Contains(p.(string), tt.want) {
+					t.Errorf("RegisterFunction(%q) panicked with %v, want %q", tt.name, p, tt.want)
+				}
+			}()
+			RegisterFunction(tt.name, tt.fn)
+		}()
+	}
+}
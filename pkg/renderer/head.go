@@ -0,0 +1,61 @@
+package renderer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// headScript normalizes globalThis.__SSR_HEAD__ to JSON. It may be a string
+// of head tags or an object with head, htmlAttrs, bodyAttrs and bodyEnd.
+// Attribute values become strings; null, undefined and false drop the
+// attribute and true renders it empty.
+const headScript = `(h => {
+  if (typeof h === 'string')
+    return JSON.stringify({ head: h })
+  if (!h || typeof h !== 'object')
+    return '{}'
+  const attrs = a => a && typeof a === 'object'
+    ? Object.fromEntries(Object.entries(a)
+        .filter(([, v]) => v !== null && v !== undefined && v !== false)
+        .map(([k, v]) => [k, v === true ? '' : String(v)]))
+    : undefined
+  return JSON.stringify({
+    head: String(h.head ?? ''),
+    htmlAttrs: attrs(h.htmlAttrs),
+    bodyAttrs: attrs(h.bodyAttrs),
+    bodyEnd: String(h.bodyEnd ?? ''),
+  })
+})(globalThis.__SSR_HEAD__)`
+
+type headState struct {
+	Head      string            `json:"head"`
+	HTMLAttrs map[string]string `json:"htmlAttrs"`
+	BodyAttrs map[string]string `json:"bodyAttrs"`
+	BodyEnd   string            `json:"bodyEnd"`
+}
+
+// parseHead decodes the output of headScript.
+func parseHead(raw string) (headState, error) {
+	var head headState
+	if err := json.Unmarshal([]byte(raw), &head); err != nil {
+		return headState{}, fmt.Errorf("invalid __SSR_HEAD__: %w", err)
+	}
+	return head, nil
+}
+
+func (h headState) apply(res *Result) {
+	res.Head = h.Head
+	res.HTMLAttrs = h.HTMLAttrs
+	res.BodyAttrs = h.BodyAttrs
+	res.BodyEnd = h.BodyEnd
+}
+
+// lateHead returns the part of head set after streamed was flushed with the
+// first chunk.
+func lateHead(streamed, head string) string {
+	if streamed != "" && strings.HasPrefix(head, streamed) {
+		return head[len(streamed):]
+	}
+	return head
+}
@@ -0,0 +1,85 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"rogchap.com/v8go"
+)
+
+// hostObjectName is the global the host functions are reachable through
+// while preludes run. It is deleted before server.js executes.
+const hostObjectName = "__ssrHost"
+
+// setHostFunc exposes fn on the host object. Errors are thrown into JS as
+// Error instances.
+func (c *IsolateContainer) setHostFunc(name string, fn hostFunc) error {
+	tmpl := v8go.NewFunctionTemplate(c.Isolate, func(info *v8go.FunctionCallbackInfo) *v8go.Value {
+		if c.state == nil {
+			return nil
+		}
+
+		val, err := fn(c, info)
+		if err != nil {
+			return c.Isolate.ThrowException(newJSError(info.Context(), err))
+		}
+		return val
+	})
+
+	return c.host.Set(name, tmpl)
+}
+
+func newJSError(ctx *v8go.Context, err error) *v8go.Value {
+	msg, _ := v8go.NewValue(ctx.Isolate(), err.Error())
+
+	ctor, getErr := ctx.Global().Get("Error")
+	if getErr != nil {
+		return msg
+	}
+	fn, fnErr := ctor.AsFunction()
+	if fnErr != nil {
+		return msg
+	}
+	obj, newErr := fn.NewInstance(msg)
+	if newErr != nil {
+		return msg
+	}
+	return obj.Value
+}
+
+// addPrelude compiles a script that evaluates to a function taking the host
+// object. Preludes run in every context before server.js.
+func (c *IsolateContainer) addPrelude(source, origin string) error {
+	script, err := c.Isolate.CompileUnboundScript(source, origin, v8go.CompileOptions{})
+	if err != nil {
+		return formatError(err)
+	}
+
+	c.preludes = append(c.preludes, script)
+	return nil
+}
+
+func runPreludes(ctx *v8go.Context, c *IsolateContainer) error {
+	global := ctx.Global()
+	host, err := global.Get(hostObjectName)
+	if err != nil {
+		return err
+	}
+	defer global.Delete(hostObjectName)
+
+	for _, script := range c.preludes {
+		val, err := script.Run(ctx)
+		if err != nil {
+			return formatError(err)
+		}
+
+		fn, err := val.AsFunction()
+		if err != nil {
+			return err
+		}
+		if _, err := fn.Call(v8go.Undefined(c.Isolate), host); err != nil {
+			return formatError(err)
+		}
+	}
+
+	return nil
+}
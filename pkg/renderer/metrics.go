@@ -0,0 +1,61 @@
+package renderer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons an isolate leaves the pool before the pool is closed.
+const (
+	recycleMaxRenders = "max_renders"
+	recycleMaxAge     = "max_age"
+	recycleTerminated = "terminated"
+	recycleOverflow   = "overflow"
+	recycleHeapSize   = "heap_size"
+	recycleHeapGrowth = "heap_growth"
+	recycleHeapLimit  = "heap_limit"
+)
+
+var (
+	isolatesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "isolates_created_total",
+		Help:      "V8 isolates created by SSR isolate pools.",
+	})
+	isolatesRecycled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "isolates_recycled_total",
+		Help:      "V8 isolates disposed before their pool was closed, by reason.",
+	}, []string{"reason"})
+	nodeWorkerRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "node_worker_restarts_total",
+		Help:      "Node.js render workers restarted after they exited.",
+	})
+	isolateHeapUsed = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "isolate_heap_used_bytes",
+		Help:      "Used V8 heap of an isolate after each render.",
+		Buckets:   prometheus.ExponentialBuckets(4<<20, 2, 10),
+	})
+	workerRenders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "worker_renders_total",
+		Help:      "Renders run by SSR render workers, by worker.",
+	}, []string{"worker"})
+	workerBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ssr",
+		Name:      "worker_busy_seconds_total",
+		Help:      "Time SSR render workers spent rendering, by worker.",
+	}, []string{"worker"})
+	workerQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "worker_queue_wait_seconds",
+		Help:      "Time renders waited for an SSR render worker, by priority.",
+	}, []string{"priority"})
+	fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ssr",
+		Name:      "fetch_duration_seconds",
+		Help:      "Duration of in-process fetch() calls made by server.js, by response code.",
+	}, []string{"code"})
+)
@@ -0,0 +1,852 @@
+package renderer
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed node_worker.js
+var nodeWorkerScript string
+
+// ErrNodeRendererClosed is returned by renders after Close.
+var ErrNodeRendererClosed = errors.New("node renderer closed")
+
+const (
+	defaultNodeKillGrace = 5 * time.Second
+	nodeStartTimeout     = 30 * time.Second
+	nodeRestartMin       = 100 * time.Millisecond
+	nodeRestartMax       = 10 * time.Second
+	// nodeRestartReset is how long a worker must run before a crash no
+	// longer counts towards the restart backoff.
+	nodeRestartReset = time.Minute
+	nodeMaxFrame     = 256 << 20
+)
+
+// NodeOptions configures NewNodeRenderer.
+type NodeOptions struct {
+	// Command is the Node.js binary; defaults to "node".
+	Command string
+	// Args are passed to node before the worker script, e.g.
+	// --max-old-space-size=512.
+	Args []string
+	// Dir is the worker's working directory. Bare require() calls in the
+	// bundle resolve node_modules from it.
+	Dir string
+	// Env is added to the environment the worker inherits.
+	Env []string
+
+	// FetchHandler serves fetch() in-process like WithFetch does for the V8
+	// renderer, limited by Fetch. Without it server.js gets Node's fetch.
+	FetchHandler http.Handler
+	Fetch        FetchOptions
+	// ConsoleMaxLines caps how many console lines a single render may log.
+	ConsoleMaxLines int
+	// KillGrace is how long the worker may take to acknowledge a cancelled
+	// render before it is considered stuck, killed and restarted.
+	KillGrace time.Duration
+}
+
+// NodeRenderer renders server.js in a long-lived Node.js worker process. It
+// starts the worker, restarts it with backoff whenever it exits, and stops it
+// on Close. The Go binary needs neither cgo nor V8, and server.js gets the
+// whole Node.js runtime: bare require() calls load built-ins and
+// node_modules.
+//
+// One worker runs on one core; concurrent renders interleave on its event
+// loop. The worker talks to Go over a pipe pair with length-prefixed JSON
+// frames, so it only runs where exec.Cmd supports ExtraFiles (not Windows).
+type NodeRenderer struct {
+	bundle *bundle
+	opts   NodeOptions
+	script string
+	init   nodeInit
+	// functions are the Go functions registered when the renderer started.
+	functions map[string]*hostFunction
+
+	mu     sync.Mutex
+	worker *nodeWorker
+	// changed is closed and replaced whenever worker is, or on Close.
+	changed chan struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+// NewNodeRenderer starts a worker for the bundle in serverDist, with entry as
+// its CommonJS entry. It returns an error when the worker cannot be started
+// or the entry fails to compile.
+func NewNodeRenderer(serverDist fs.FS, entry string, opts NodeOptions) (*NodeRenderer, error) {
+	if opts.Command == "" {
+		opts.Command = "node"
+	}
+	if opts.ConsoleMaxLines <= 0 {
+		opts.ConsoleMaxLines = defaultConsoleMaxLines
+	}
+	if opts.KillGrace <= 0 {
+		opts.KillGrace = defaultNodeKillGrace
+	}
+	opts.Fetch = opts.Fetch.withDefaults()
+
+	b, err := loadBundle(serverDist, entry)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", entry, err)
+	}
+	modules, err := b.modules()
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", entry, err)
+	}
+
+	script, err := os.CreateTemp("", "ssr-node-worker-*.js")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(script, nodeWorkerScript)
+	if closeErr := script.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(script.Name())
+		return nil, err
+	}
+
+	methods := make([]string, 0, len(consoleLevels))
+	for method := range consoleLevels {
+		methods = append(methods, method)
+	}
+
+	r := &NodeRenderer{
+		bundle: b,
+		opts:   opts,
+		script: script.Name(),
+		init: nodeInit{
+			Type:            "init",
+			Entry:           b.entry,
+			Modules:         modules,
+			ResponsePrelude: responsePrelude,
+			RequestPrelude:  requestInfoPrelude,
+			FunctionPrelude: functionPrelude,
+			HeadScript:      headScript,
+			ResponseScript:  responseScript,
+			StateScript:     appStateScript,
+			Fetch:           opts.FetchHandler != nil,
+			ConsoleMethods:  methods,
+			ConsoleNoops:    consoleNoops,
+		},
+		functions: registeredFunctions(),
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if len(r.functions) > 0 {
+		r.init.Functions = functionList(r.functions)
+	}
+
+	w, err := r.start()
+	if err != nil {
+		os.Remove(r.script)
+		return nil, err
+	}
+	r.worker = w
+	go r.supervise(w)
+
+	return r, nil
+}
+
+// modules returns the wrapped source of every module the bundle may
+// require, keyed by name.
+func (b *bundle) modules() (map[string]string, error) {
+	modules := map[string]string{}
+	err := fs.WalkDir(b.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch path.Ext(name) {
+		case ".js", ".cjs", ".json":
+			src, err := b.source(name)
+			if err != nil {
+				return err
+			}
+			modules[name] = src
+		}
+		return nil
+	})
+	return modules, err
+}
+
+// BundleHash returns the SHA-256 fingerprint of the server bundle, covering
+// the entry and every chunk.
+func (r *NodeRenderer) BundleHash() string {
+	return r.bundle.hash
+}
+
+// Render renders urlPath in the worker. When ctx is cancelled or its deadline
+// passes the render is abandoned; synchronous code in the worker is stopped
+// at the deadline.
+func (r *NodeRenderer) Render(ctx context.Context, urlPath string, payload map[string]any) (Result, error) {
+	return r.run(ctx, urlPath, payload, nil)
+}
+
+// RenderStream renders like Render but hands HTML to w as server.js produces
+// it; see Renderer.RenderStream.
+func (r *NodeRenderer) RenderStream(ctx context.Context, urlPath string, payload map[string]any, w StreamWriter) (Result, error) {
+	return r.run(ctx, urlPath, payload, w)
+}
+
+// Close stops the worker. Renders still waiting on it fail.
+func (r *NodeRenderer) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	w := r.worker
+	close(r.changed)
+	r.mu.Unlock()
+
+	close(r.done)
+	w.stop(r.opts.KillGrace)
+	go func() {
+		<-w.exited
+		os.Remove(r.script)
+	}()
+}
+
+func (r *NodeRenderer) run(ctx context.Context, urlPath string, payload map[string]any, stream StreamWriter) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, fmt.Errorf("render aborted: %w", err)
+	}
+
+	w, err := r.current(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	msg := nodeMessage{Type: "render", URL: urlPath, Stream: stream != nil}
+	if len(payload) > 0 {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return Result{}, err
+		}
+		msg.Data = string(data)
+	}
+	if msg.RequestInfo, err = requestInfoJSON(ctx); err != nil {
+		return Result{}, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Timeout = max(time.Until(deadline).Milliseconds(), 1)
+	}
+
+	requestID := RequestIDFromContext(ctx)
+	rr := &nodeRender{
+		ctx:     ctx,
+		request: RequestFromContext(ctx),
+		console: consoleLog{
+			ctx:       ctx,
+			path:      urlPath,
+			requestID: requestID,
+			bundle:    r.bundle,
+			maxLines:  r.opts.ConsoleMaxLines,
+		},
+		notify: make(chan struct{}, 1),
+	}
+	msg.ID = w.register(rr)
+	defer w.unregister(msg.ID)
+
+	if err := w.send(msg); err != nil {
+		return Result{}, fmt.Errorf("send render to node worker: %w", err)
+	}
+
+	result, err := r.wait(ctx, w, msg.ID, rr, stream)
+	return result, r.bundle.mapError(err)
+}
+
+// wait handles the worker's messages for render id until it finishes.
+func (r *NodeRenderer) wait(ctx context.Context, w *nodeWorker, id uint64, rr *nodeRender, stream StreamWriter) (Result, error) {
+	var streamedHead string
+	for {
+		select {
+		case <-rr.notify:
+		case <-w.exited:
+			return Result{}, errors.New("node worker exited during render")
+		case <-ctx.Done():
+			w.cancel(id, r.opts.KillGrace)
+			return Result{}, fmt.Errorf("render aborted: %w", ctx.Err())
+		}
+
+		for _, ev := range rr.take() {
+			switch ev.Type {
+			case "error":
+				return Result{}, errors.New(ev.Error)
+
+			case "head":
+				var res Result
+				head, err := ev.readHead(&res)
+				if err == nil {
+					streamedHead = head.Head
+					err = stream.WriteHead(res)
+				}
+				if err != nil {
+					w.cancel(id, r.opts.KillGrace)
+					return Result{}, err
+				}
+
+			case "chunk":
+				if err := stream.WriteChunk(ev.HTML); err != nil {
+					w.cancel(id, r.opts.KillGrace)
+					return Result{}, err
+				}
+
+			case "done":
+				res := Result{HTML: ev.HTML}
+				head, err := ev.readHead(&res)
+				if err != nil {
+					return Result{}, err
+				}
+				if ev.State != nil {
+					if res.State, err = parseAppState(*ev.State); err != nil {
+						return Result{}, err
+					}
+				}
+				if stream != nil {
+					return Result{Head: lateHead(streamedHead, head.Head), BodyEnd: head.BodyEnd, State: res.State}, nil
+				}
+				return res, nil
+			}
+		}
+	}
+}
+
+// current returns the running worker, waiting while it is being restarted.
+func (r *NodeRenderer) current(ctx context.Context) (*nodeWorker, error) {
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, ErrNodeRendererClosed
+		}
+		w, changed := r.worker, r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-w.exited:
+		default:
+			return w, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("node worker unavailable: %w", ctx.Err())
+		}
+	}
+}
+
+// supervise restarts the worker whenever it exits, until Close.
+func (r *NodeRenderer) supervise(w *nodeWorker) {
+	backoff := nodeRestartMin
+	for {
+		select {
+		case <-w.exited:
+		case <-r.done:
+			return
+		}
+		log.Printf("ssr node worker exited pid=%d err=%v", w.cmd.Process.Pid, w.err)
+		if time.Since(w.started) > nodeRestartReset {
+			backoff = nodeRestartMin
+		}
+
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-r.done:
+				return
+			}
+			backoff = min(backoff*2, nodeRestartMax)
+
+			next, err := r.start()
+			if err == nil {
+				w = next
+				break
+			}
+			log.Printf("ssr node worker restart failed err=%v", err)
+		}
+		nodeWorkerRestarts.Inc()
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			w.stop(r.opts.KillGrace)
+			return
+		}
+		r.worker = w
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.mu.Unlock()
+	}
+}
+
+// start launches a worker and waits until it has compiled the entry.
+func (r *NodeRenderer) start() (*nodeWorker, error) {
+	toWorker, workerIn, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	workerOut, fromWorker, err := os.Pipe()
+	if err != nil {
+		toWorker.Close()
+		workerIn.Close()
+		return nil, err
+	}
+
+	// Calls to Go functions get their own pipe pair, which the worker
+	// blocks on for an answer.
+	callsOut, callsFromWorker, err := os.Pipe()
+	if err != nil {
+		closeFiles(toWorker, workerIn, workerOut, fromWorker)
+		return nil, err
+	}
+	callsToWorker, callsIn, err := os.Pipe()
+	if err != nil {
+		closeFiles(toWorker, workerIn, workerOut, fromWorker, callsOut, callsFromWorker)
+		return nil, err
+	}
+
+	cmd := exec.Command(r.opts.Command, append(append([]string{}, r.opts.Args...), r.script)...)
+	cmd.Dir = r.opts.Dir
+	cmd.Env = append(os.Environ(), r.opts.Env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// The worker reads fd 3 and writes fd 4, and makes calls on fd 5 that
+	// are answered on fd 6.
+	cmd.ExtraFiles = []*os.File{toWorker, fromWorker, callsFromWorker, callsToWorker}
+
+	err = cmd.Start()
+	closeFiles(toWorker, fromWorker, callsFromWorker, callsToWorker)
+	if err != nil {
+		closeFiles(workerIn, workerOut, callsOut, callsIn)
+		return nil, fmt.Errorf("start node worker: %w", err)
+	}
+
+	w := &nodeWorker{
+		r:         r,
+		cmd:       cmd,
+		started:   time.Now(),
+		in:        workerIn,
+		out:       workerOut,
+		renders:   map[uint64]*nodeRender{},
+		cancelled: map[uint64]*time.Timer{},
+		ready:     make(chan nodeMessage, 1),
+		exited:    make(chan struct{}),
+	}
+	go w.loop()
+	go w.serveCalls(callsOut, callsIn)
+
+	if err := w.send(r.init); err != nil {
+		w.kill()
+		return nil, fmt.Errorf("start node worker: %w", err)
+	}
+
+	timer := time.NewTimer(nodeStartTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-w.ready:
+		if msg.Error != "" {
+			w.stop(r.opts.KillGrace)
+			return nil, r.bundle.mapError(errors.New(msg.Error))
+		}
+		return w, nil
+	case <-w.exited:
+		return nil, fmt.Errorf("node worker exited during startup: %v", w.err)
+	case <-timer.C:
+		w.kill()
+		return nil, errors.New("node worker did not start in time")
+	}
+}
+
+// nodeInit is the first message to a worker: the bundle and the scripts it
+// shares with the V8 renderer.
+type nodeInit struct {
+	Type            string            `json:"type"`
+	Entry           string            `json:"entry"`
+	Modules         map[string]string `json:"modules"`
+	ResponsePrelude string            `json:"responsePrelude"`
+	RequestPrelude  string            `json:"requestPrelude"`
+	FunctionPrelude string            `json:"functionPrelude"`
+	// Functions lists the registered Go functions; empty when there are
+	// none.
+	Functions      string   `json:"functions,omitempty"`
+	HeadScript     string   `json:"headScript"`
+	ResponseScript string   `json:"responseScript"`
+	StateScript    string   `json:"stateScript"`
+	Fetch          bool     `json:"fetch"`
+	ConsoleMethods []string `json:"consoleMethods"`
+	ConsoleNoops   []string `json:"consoleNoops"`
+}
+
+// nodeMessage is a frame of the worker protocol after init. Which fields are
+// set depends on Type.
+type nodeMessage struct {
+	Type string `json:"type"`
+	// ID names the render the message belongs to.
+	ID uint64 `json:"id,omitempty"`
+	// Call pairs a fetch from the worker with its reply.
+	Call uint64 `json:"call,omitempty"`
+
+	URL     string `json:"url,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Stream  bool   `json:"stream,omitempty"`
+	Timeout int64  `json:"timeout,omitempty"`
+	// RequestInfo is the JSON of __SSR_REQUEST__.
+	RequestInfo string `json:"requestInfo,omitempty"`
+
+	// Head, Response and State hold the output of headScript,
+	// responseScript and appStateScript.
+	HTML     string  `json:"html,omitempty"`
+	Head     *string `json:"head,omitempty"`
+	Response *string `json:"response,omitempty"`
+	State    *string `json:"state,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	Level string `json:"level,omitempty"`
+	Line  string `json:"line,omitempty"`
+
+	Request *fetchRequest  `json:"request,omitempty"`
+	Reply   *fetchResponse `json:"reply,omitempty"`
+
+	// Name and Args call a Go function; Result holds its JSON result.
+	Name   string `json:"name,omitempty"`
+	Args   string `json:"args,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+// readHead applies the head and response fields to res.
+func (m nodeMessage) readHead(res *Result) (headState, error) {
+	var head headState
+	if m.Head != nil {
+		var err error
+		if head, err = parseHead(*m.Head); err != nil {
+			return headState{}, err
+		}
+	}
+	head.apply(res)
+	if m.Response != nil {
+		if err := parseResponse(*m.Response, res); err != nil {
+			return headState{}, err
+		}
+	}
+	return head, nil
+}
+
+// nodeRender is a render in flight in a worker. Its messages are queued for
+// the goroutine waiting on it, so a slow client does not hold up the
+// worker's other renders.
+type nodeRender struct {
+	ctx     context.Context
+	request *http.Request
+	console consoleLog
+	fetches atomic.Int32
+
+	mu     sync.Mutex
+	events []nodeMessage
+	notify chan struct{}
+}
+
+func (rr *nodeRender) push(msg nodeMessage) {
+	rr.mu.Lock()
+	rr.events = append(rr.events, msg)
+	rr.mu.Unlock()
+	select {
+	case rr.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (rr *nodeRender) take() []nodeMessage {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	events := rr.events
+	rr.events = nil
+	return events
+}
+
+// nodeWorker is one Node.js process.
+type nodeWorker struct {
+	r       *NodeRenderer
+	cmd     *exec.Cmd
+	started time.Time
+
+	in      *os.File
+	out     *os.File
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	renders map[uint64]*nodeRender
+	// cancelled holds the kill timers of cancelled renders the worker has
+	// not acknowledged yet.
+	cancelled map[uint64]*time.Timer
+
+	ready  chan nodeMessage
+	exited chan struct{}
+	err    error
+}
+
+func (w *nodeWorker) register(rr *nodeRender) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextID++
+	w.renders[w.nextID] = rr
+	return w.nextID
+}
+
+func (w *nodeWorker) unregister(id uint64) {
+	w.mu.Lock()
+	delete(w.renders, id)
+	w.mu.Unlock()
+}
+
+func (w *nodeWorker) render(id uint64) *nodeRender {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.renders[id]
+}
+
+func (w *nodeWorker) send(msg any) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return writeFrame(w.in, msg)
+}
+
+// writeFrame writes msg as a length-prefixed JSON frame.
+func writeFrame(out io.Writer, msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	frame = append(frame, body...)
+	_, err = out.Write(frame)
+	return err
+}
+
+// readFrame reads a frame written by the worker. It returns io.EOF when
+// the worker closed the pipe between frames.
+func readFrame(br *bufio.Reader) (nodeMessage, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nodeMessage{}, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > nodeMaxFrame {
+		return nodeMessage{}, fmt.Errorf("frame of %d bytes exceeds the limit", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nodeMessage{}, err
+	}
+
+	var msg nodeMessage
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+// cancel tells the worker to abandon render id. A worker that does not
+// acknowledge within grace is stuck in synchronous code and is killed.
+func (w *nodeWorker) cancel(id uint64, grace time.Duration) {
+	w.mu.Lock()
+	w.cancelled[id] = time.AfterFunc(grace, func() {
+		log.Printf("ssr node worker stuck on cancelled render; killing pid=%d", w.cmd.Process.Pid)
+		w.kill()
+	})
+	w.mu.Unlock()
+
+	if err := w.send(nodeMessage{Type: "cancel", ID: id}); err != nil {
+		w.kill()
+	}
+}
+
+func (w *nodeWorker) acknowledge(id uint64) {
+	w.mu.Lock()
+	if t, ok := w.cancelled[id]; ok {
+		t.Stop()
+		delete(w.cancelled, id)
+	}
+	w.mu.Unlock()
+}
+
+// stop closes the worker's input, which makes it exit, and kills it if it
+// is still running after grace.
+func (w *nodeWorker) stop(grace time.Duration) {
+	w.writeMu.Lock()
+	w.in.Close()
+	w.writeMu.Unlock()
+
+	go func() {
+		select {
+		case <-w.exited:
+		case <-time.After(grace):
+			w.kill()
+		}
+	}()
+}
+
+func (w *nodeWorker) kill() {
+	if err := w.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Printf("ssr node worker kill failed pid=%d err=%v", w.cmd.Process.Pid, err)
+	}
+}
+
+// loop reads frames until the worker exits, then reaps it.
+func (w *nodeWorker) loop() {
+	if err := w.read(); err != nil {
+		log.Printf("ssr node worker protocol error pid=%d err=%v", w.cmd.Process.Pid, err)
+		w.kill()
+	}
+	w.out.Close()
+	w.err = w.cmd.Wait()
+
+	w.mu.Lock()
+	for _, t := range w.cancelled {
+		t.Stop()
+	}
+	w.mu.Unlock()
+	close(w.exited)
+}
+
+func (w *nodeWorker) read() error {
+	br := bufio.NewReader(w.out)
+	for {
+		msg, err := readFrame(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		w.dispatch(msg)
+	}
+}
+
+func (w *nodeWorker) dispatch(msg nodeMessage) {
+	if msg.Type == "ready" {
+		w.ready <- msg
+		return
+	}
+	if msg.Type == "cancelled" {
+		w.acknowledge(msg.ID)
+		return
+	}
+
+	rr := w.render(msg.ID)
+	if rr == nil {
+		return
+	}
+
+	switch msg.Type {
+	case "console":
+		level, ok := consoleLevels[msg.Level]
+		if !ok {
+			level = slog.LevelInfo
+		}
+		if rr.console.allow() {
+			rr.console.write(level, msg.Line)
+		}
+
+	case "fetch":
+		if msg.Request == nil {
+			return
+		}
+		go w.fetch(rr, msg.Call, *msg.Request)
+
+	case "call":
+		go w.callAsync(rr, msg)
+
+	default:
+		rr.push(msg)
+	}
+}
+
+// fetch serves a fetch() call of rr with the renderer's fetch handler.
+func (w *nodeWorker) fetch(rr *nodeRender, call uint64, req fetchRequest) {
+	opts := w.r.opts.Fetch
+	res := fetchBudgetError(opts)
+	if int(rr.fetches.Add(1)) <= opts.MaxRequests {
+		res = serveFetch(rr.ctx, rr.request, w.r.opts.FetchHandler, opts, req)
+	}
+	if err := w.send(nodeMessage{Type: "fetch", Call: call, Reply: &res}); err != nil {
+		log.Printf("ssr node worker fetch reply failed err=%v", err)
+	}
+}
+
+// callAsync runs an async Go function for rr and answers the worker.
+func (w *nodeWorker) callAsync(rr *nodeRender, msg nodeMessage) {
+	reply := nodeMessage{Type: "called", Call: msg.Call}
+	reply.Result, reply.Error = w.r.callFunction(rr, msg, true)
+	if err := w.send(reply); err != nil {
+		log.Printf("ssr node worker call reply failed err=%v", err)
+	}
+}
+
+// serveCalls answers the worker's synchronous calls of Go functions until
+// it closes the pipe. The worker blocks until the answer arrives.
+func (w *nodeWorker) serveCalls(calls, answers *os.File) {
+	defer closeFiles(calls, answers)
+
+	br := bufio.NewReader(calls)
+	for {
+		msg, err := readFrame(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				log.Printf("ssr node worker call pipe failed pid=%d err=%v", w.cmd.Process.Pid, err)
+				w.kill()
+			}
+			return
+		}
+
+		var reply nodeMessage
+		if rr := w.render(msg.ID); rr != nil {
+			reply.Result, reply.Error = w.r.callFunction(rr, msg, false)
+		} else {
+			reply.Error = "render was cancelled"
+		}
+		if err := writeFrame(answers, reply); err != nil {
+			return
+		}
+	}
+}
+
+// callFunction calls the Go function msg names for rr and returns its JSON
+// result or error text.
+func (r *NodeRenderer) callFunction(rr *nodeRender, msg nodeMessage, async bool) (string, string) {
+	f, ok := r.functions[msg.Name]
+	if !ok || f.async != async {
+		return "", fmt.Sprintf("no Go function %q", msg.Name)
+	}
+	result, err := f.call(rr.ctx, msg.Args)
+	if err != nil {
+		return "", err.Error()
+	}
+	return result, ""
+}
+
+func closeFiles(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
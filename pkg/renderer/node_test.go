@@ -0,0 +1,93 @@
+package renderer
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestNode starts a NodeRenderer whose server.js renders the path and the
+// worker's pid, spins after an await on /spin and exits on /crash.
+func newTestNode(t *testing.T) *NodeRenderer {
+	t.Helper()
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not on PATH")
+	}
+	bundle := fstest.MapFS{"server.js": {Data: []byte(`globalThis.ssrRender = async (p) => {
+  if (p === "/spin") { await null; for (;;) {} }
+  if (p === "/crash") process.exit(1)
+  return p + " " + (globalThis.__SSR_DATA__?.name ?? "") + " " + process.pid
+}`)}}
+	r, err := NewNodeRenderer(bundle, "server.js", NodeOptions{KillGrace: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func nodeWorkerPid(r *NodeRenderer) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.worker.cmd.Process.Pid
+}
+
+// renderAfterRestart renders / once the worker that had pid was replaced.
+func renderAfterRestart(t *testing.T, r *NodeRenderer, pid int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for nodeWorkerPid(r) == pid {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("worker pid=%d was not replaced", pid)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	res, err := r.Render(ctx, "/", nil)
+	if err != nil {
+		t.Fatalf("render after the restart: %v", err)
+	}
+	if want := "/  " + strconv.Itoa(nodeWorkerPid(r)); res.HTML != want {
+		t.Fatalf("render after the restart = %q, want %q", res.HTML, want)
+	}
+}
+
+func TestNodeRender(t *testing.T) {
+	r := newTestNode(t)
+
+	res, err := r.Render(context.Background(), "/about", map[string]any{"name": "ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/about ada " + strconv.Itoa(nodeWorkerPid(r)); res.HTML != want {
+		t.Fatalf("render = %q, want %q", res.HTML, want)
+	}
+}
+
+func TestNodeRenderTimeoutKillsWorker(t *testing.T) {
+	r := newTestNode(t)
+	pid := nodeWorkerPid(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := r.Render(ctx, "/spin", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("spinning render returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	renderAfterRestart(t, r, pid)
+}
+
+func TestNodeRestartsAfterCrash(t *testing.T) {
+	r := newTestNode(t)
+	pid := nodeWorkerPid(r)
+
+	if _, err := r.Render(context.Background(), "/crash", nil); err == nil {
+		t.Fatal("render that exits the worker succeeded")
+	}
+	renderAfterRestart(t, r, pid)
+}
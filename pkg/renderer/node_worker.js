@@ -0,0 +1,439 @@
+// Render worker of NodeRenderer (see node.go). Go starts it with the protocol
+// pipes on fd 3 (Go to worker) and fd 4 (worker to Go), so output of the
+// bundle on stdout and stderr cannot corrupt the protocol. Every message is a
+// 4-byte big-endian length followed by a JSON object.
+//
+// Go functions registered with RegisterFunction answer on a second pipe pair,
+// fd 5 (worker to Go) and fd 6 (Go to worker), which the worker blocks on, so
+// that they can return synchronously.
+//
+// Each render runs server.js in a fresh vm context, as the V8 renderer does,
+// so globals such as __SSR_DATA__ and __SSR_RESPONSE__ never leak between
+// renders that are in flight together. Bundle modules are compiled once and
+// evaluated per render; bare specifiers load through Node's own require.
+'use strict'
+
+const fs = require('node:fs')
+const path = require('node:path')
+const util = require('node:util')
+const vm = require('node:vm')
+const { createRequire } = require('node:module')
+
+const input = fs.createReadStream(null, { fd: 3 })
+const output = fs.createWriteStream(null, { fd: 4 })
+
+const nodeRequire = createRequire(path.join(process.cwd(), 'ssr-worker.js'))
+
+let config = null
+const scripts = new Map()
+const renders = new Map()
+const calls = new Map()
+let nextCall = 0
+
+function send(msg) {
+  const body = Buffer.from(JSON.stringify(msg))
+  const header = Buffer.alloc(4)
+  header.writeUInt32BE(body.length)
+  output.write(Buffer.concat([header, body]))
+}
+
+let pending = Buffer.alloc(0)
+input.on('data', (chunk) => {
+  pending = pending.length ? Buffer.concat([pending, chunk]) : chunk
+  while (pending.length >= 4) {
+    const size = pending.readUInt32BE(0)
+    if (pending.length < 4 + size)
+      break
+    const msg = JSON.parse(pending.subarray(4, 4 + size).toString())
+    pending = pending.subarray(4 + size)
+    dispatch(msg)
+  }
+})
+// Go closes its end to stop the worker.
+input.on('end', () => process.exit(0))
+
+function dispatch(msg) {
+  switch (msg.type) {
+    case 'init':
+      init(msg)
+      break
+    case 'render':
+      render(msg)
+      break
+    case 'cancel':
+      cancel(msg.id)
+      break
+    case 'fetch':
+    case 'called': {
+      const resolve = calls.get(msg.call)
+      calls.delete(msg.call)
+      if (resolve)
+        resolve(msg.type === 'fetch' ? msg.reply : msg)
+      break
+    }
+  }
+}
+
+function init(msg) {
+  config = msg
+  try {
+    compile(config.entry)
+    send({ type: 'ready' })
+  }
+  catch (err) {
+    send({ type: 'ready', error: errorStack(err) })
+  }
+}
+
+function errorStack(err) {
+  if (err && typeof err === 'object' && typeof err.stack === 'string')
+    return err.stack
+  return String(err)
+}
+
+// compile returns the script of a bundle module, a CommonJS wrapper that
+// Go prepared with the same line layout the V8 renderer uses.
+function compile(name) {
+  let script = scripts.get(name)
+  if (!script) {
+    const source = config.modules[name]
+    if (source === undefined)
+      throw new Error(`Cannot find module '${name}'`)
+    script = new vm.Script(source, { filename: name })
+    scripts.set(name, script)
+  }
+  return script
+}
+
+function dirname(filename) {
+  const i = filename.lastIndexOf('/')
+  return i === -1 ? '' : filename.slice(0, i)
+}
+
+// resolve mirrors bundle.resolve in Go.
+function resolve(dir, spec) {
+  let base = spec.startsWith('/') ? path.posix.normalize(spec) : path.posix.join('/', dir, spec)
+  base = base.replace(/^\/+/, '')
+  if (base === '')
+    return null
+  for (const candidate of [base, `${base}.js`, `${base}.cjs`, `${base}.json`, path.posix.join(base, 'index.js')]) {
+    if (config.modules[candidate] !== undefined)
+      return candidate
+  }
+  return null
+}
+
+function makeRequire(state, dir) {
+  const require = (spec) => {
+    spec = String(spec)
+    if (!spec.startsWith('./') && !spec.startsWith('../') && !spec.startsWith('/'))
+      return nodeRequire(spec)
+    return load(state, require.resolve(spec))
+  }
+  require.resolve = (spec) => {
+    const resolved = resolve(dir, String(spec))
+    if (resolved === null)
+      throw new Error(`Cannot find module '${spec}' from '${dir}'`)
+    return resolved
+  }
+  require.cache = state.modules
+  return require
+}
+
+function load(state, filename) {
+  const cached = state.modules[filename]
+  if (cached)
+    return cached.exports
+
+  const module = state.newObject()
+  Object.assign(module, { id: filename, filename, exports: state.newObject(), loaded: false })
+  state.modules[filename] = module
+
+  const wrapper = compile(filename).runInContext(state.context)
+  try {
+    wrapper.call(module.exports, module.exports, makeRequire(state, dirname(filename)), module, filename, dirname(filename))
+  }
+  catch (err) {
+    delete state.modules[filename]
+    throw err
+  }
+  module.loaded = true
+  return module.exports
+}
+
+function makeConsole(state) {
+  const console = {}
+  for (const method of config.consoleMethods) {
+    console[method] = (...args) => {
+      if (!state.cancelled)
+        send({ type: 'console', id: state.id, level: method, line: util.format(...args) })
+    }
+  }
+  for (const method of config.consoleNoops)
+    console[method] = () => {}
+  return console
+}
+
+// Timers are tracked so that those a render leaves behind are cleared when
+// it ends.
+function makeTimers(state) {
+  const wrap = (schedule, repeat) => (fn, delay, ...args) => {
+    const handle = schedule(() => {
+      if (!repeat)
+        state.timers.delete(handle)
+      fn(...args)
+    }, delay)
+    state.timers.add(handle)
+    return handle
+  }
+  const clear = (handle) => {
+    state.timers.delete(handle)
+    clearTimeout(handle)
+  }
+  return {
+    setTimeout: wrap(setTimeout, false),
+    setInterval: wrap(setInterval, true),
+    clearTimeout: clear,
+    clearInterval: clear,
+  }
+}
+
+// makeFetch routes fetch() through Go, which serves it in-process the way
+// the V8 renderer does.
+function makeFetch(state) {
+  return async (input, init = {}) => {
+    const request = input instanceof Request ? input : null
+    const url = typeof input === 'string' ? input : (input.href ?? input.url ?? String(input))
+    const headers = new Headers(init.headers ?? request?.headers)
+    const method = String(init.method ?? request?.method ?? 'GET').toUpperCase()
+    let body = init.body ?? null
+    if (body instanceof URLSearchParams) {
+      if (!headers.has('content-type'))
+        headers.set('content-type', 'application/x-www-form-urlencoded;charset=UTF-8')
+      body = body.toString()
+    }
+    else if (body !== null && typeof body !== 'string') {
+      throw new TypeError('SSR fetch only supports string and URLSearchParams bodies')
+    }
+
+    const call = ++nextCall
+    const reply = new Promise(resolve => calls.set(call, resolve))
+    send({ type: 'fetch', id: state.id, call, request: { url: String(url), method, headers: Array.from(headers.entries()), body } })
+    const res = await reply
+    if (res.error)
+      throw new TypeError(res.error)
+
+    const empty = res.status === 204 || res.status === 304
+    const response = new Response(empty ? null : (res.body ?? ''), {
+      status: res.status,
+      statusText: res.statusText,
+      headers: res.headers,
+    })
+    Object.defineProperty(response, 'url', { value: res.url ?? '' })
+    return response
+  }
+}
+
+// makeFunctionHost is the host object function.js defines the globals of Go
+// functions from.
+function makeFunctionHost(state) {
+  return {
+    functions: config.functions,
+    callFunction(name, args) {
+      writeFrameSync(5, { id: state.id, name, args })
+      const reply = readFrameSync(6)
+      if (reply.error)
+        throw new Error(reply.error)
+      return reply.result ?? ''
+    },
+    async callAsyncFunction(name, args) {
+      const call = ++nextCall
+      const reply = new Promise(resolve => calls.set(call, resolve))
+      send({ type: 'call', id: state.id, call, name, args })
+      const res = await reply
+      if (res.error)
+        throw new Error(res.error)
+      return res.result ?? ''
+    },
+  }
+}
+
+function writeFrameSync(fd, msg) {
+  const body = Buffer.from(JSON.stringify(msg))
+  const frame = Buffer.alloc(4 + body.length)
+  frame.writeUInt32BE(body.length)
+  body.copy(frame, 4)
+  for (let off = 0; off < frame.length;)
+    off += fs.writeSync(fd, frame, off)
+}
+
+function readSync(fd, size) {
+  const buf = Buffer.alloc(size)
+  for (let off = 0; off < size;) {
+    let n
+    try {
+      n = fs.readSync(fd, buf, off, size - off)
+    }
+    catch (err) {
+      if (err.code === 'EAGAIN')
+        continue
+      throw err
+    }
+    if (n === 0)
+      throw new Error('Go closed the function pipe')
+    off += n
+  }
+  return buf
+}
+
+function readFrameSync(fd) {
+  const size = readSync(fd, 4).readUInt32BE(0)
+  return JSON.parse(readSync(fd, size).toString())
+}
+
+function newContext(state) {
+  const context = vm.createContext({}, { name: `ssr render ${state.id}` })
+  const globals = {
+    ...makeTimers(state),
+    console: makeConsole(state),
+    setImmediate,
+    clearImmediate,
+    queueMicrotask,
+    structuredClone,
+    URL,
+    URLSearchParams,
+    TextEncoder,
+    TextDecoder,
+    atob,
+    btoa,
+    crypto: globalThis.crypto,
+    performance,
+    AbortController,
+    AbortSignal,
+    Event,
+    EventTarget,
+    Blob,
+    FormData,
+    Headers,
+    Request,
+    Response,
+    Buffer,
+    process,
+    fetch: config.fetch ? makeFetch(state) : fetch,
+    require: makeRequire(state, ''),
+  }
+  for (const [name, value] of Object.entries(globals))
+    Object.defineProperty(context, name, { value, writable: true, configurable: true, enumerable: false })
+
+  state.context = context
+  state.newObject = vm.runInContext('() => ({})', context)
+  return context
+}
+
+// run evaluates code in the render's context. Synchronous code is stopped
+// when the render deadline passes.
+function run(state, code, filename) {
+  const options = { filename }
+  if (state.deadline !== Infinity)
+    options.timeout = Math.max(1, state.deadline - Date.now())
+  return vm.runInContext(code, state.context, options)
+}
+
+function read(state, script) {
+  const value = vm.runInContext(script, state.context)
+  return typeof value === 'string' ? value : null
+}
+
+async function render(msg) {
+  const state = {
+    id: msg.id,
+    deadline: msg.timeout ? Date.now() + msg.timeout : Infinity,
+    modules: Object.create(null),
+    timers: new Set(),
+    cancelled: false,
+    headSent: false,
+  }
+  renders.set(msg.id, state)
+
+  try {
+    const context = newContext(state)
+    run(state, config.responsePrelude, 'ssr-response.js')()
+    if (config.functions)
+      run(state, config.functionPrelude, 'ssr-functions.js')(makeFunctionHost(state))
+    if (msg.data)
+      context.__SSR_DATA__ = run(state, 'JSON.parse', 'ssr-data.js')(msg.data)
+    if (msg.requestInfo)
+      run(state, config.requestPrelude, 'ssr-request.js')(msg.requestInfo)
+    run(state, `require(${JSON.stringify(`./${config.entry}`)})`, 'ssr-entry.js')
+
+    const url = JSON.stringify(msg.url)
+    let html = ''
+    if (msg.stream) {
+      const write = (chunk) => {
+        if (state.cancelled)
+          throw new Error('render cancelled')
+        startStream(state)
+        chunk = chunk === undefined || chunk === null ? '' : String(chunk)
+        if (chunk !== '')
+          send({ type: 'chunk', id: state.id, html: chunk })
+      }
+      Object.defineProperty(context, '__ssrWrite', { value: write, configurable: true })
+      if (typeof context.ssrRenderStream === 'function')
+        await run(state, `ssrRenderStream(${url}, __ssrWrite)`, 'ssr-render.js')
+      else
+        write(await run(state, `ssrRender(${url})`, 'ssr-render.js'))
+      startStream(state)
+    }
+    else {
+      const value = await run(state, `ssrRender(${url})`, 'ssr-render.js')
+      html = value === undefined || value === null ? '' : String(value)
+    }
+
+    send({
+      type: 'done',
+      id: state.id,
+      html,
+      head: read(state, config.headScript),
+      response: read(state, config.responseScript),
+      state: read(state, config.stateScript),
+    })
+  }
+  catch (err) {
+    send({ type: 'error', id: state.id, error: errorStack(err) })
+  }
+  finally {
+    finish(state)
+  }
+}
+
+// startStream sends the head before the first chunk so it still carries
+// what server.js set before rendering started.
+function startStream(state) {
+  if (state.headSent)
+    return
+  state.headSent = true
+  send({
+    type: 'head',
+    id: state.id,
+    head: read(state, config.headScript),
+    response: read(state, config.responseScript),
+  })
+}
+
+function finish(state) {
+  for (const handle of state.timers)
+    clearTimeout(handle)
+  state.timers.clear()
+  renders.delete(state.id)
+}
+
+// cancel answers right away, so Go knows the event loop is not stuck, and
+// stops the render's timers. Code already running finishes on its own.
+function cancel(id) {
+  send({ type: 'cancelled', id })
+  const state = renders.get(id)
+  if (state) {
+    state.cancelled = true
+    finish(state)
+  }
+}
@@ -0,0 +1,394 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"rogchap.com/v8go"
+)
+
+//go:embed polyfills.js
+var polyfillsPrelude string
+
+// Polyfills selects the web platform APIs installed into render contexts.
+// The APIs are backed by Go host functions; polyfills.js only adapts them to
+// their standard JS shapes.
+type Polyfills struct {
+	// Timers installs setTimeout/setInterval/clearTimeout/clearInterval,
+	// driven by a per-render event loop.
+	Timers bool
+	// Microtask installs queueMicrotask.
+	Microtask bool
+	// Encoding installs TextEncoder and TextDecoder (UTF-8 only).
+	Encoding bool
+	// URL installs URL and URLSearchParams.
+	URL bool
+	// Base64 installs atob and btoa.
+	Base64 bool
+	// Crypto installs crypto.getRandomValues and crypto.randomUUID.
+	Crypto bool
+}
+
+// AllPolyfills enables every polyfill.
+func AllPolyfills() Polyfills {
+	return Polyfills{
+		Timers:    true,
+		Microtask: true,
+		Encoding:  true,
+		URL:       true,
+		Base64:    true,
+		Crypto:    true,
+	}
+}
+
+// ParsePolyfills reads a comma separated list such as "timers,url". The
+// special values "all" and "none" enable or disable everything.
+func ParsePolyfills(raw string) (Polyfills, error) {
+	p := Polyfills{}
+	for _, name := range strings.Split(raw, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "all":
+			p = AllPolyfills()
+		case "none":
+			p = Polyfills{}
+		case "timers":
+			p.Timers = true
+		case "microtask", "queuemicrotask":
+			p.Microtask = true
+		case "encoding", "textencoder", "textdecoder":
+			p.Encoding = true
+		case "url":
+			p.URL = true
+		case "base64", "atob", "btoa":
+			p.Base64 = true
+		case "crypto":
+			p.Crypto = true
+		default:
+			return Polyfills{}, fmt.Errorf("unknown polyfill %q", name)
+		}
+	}
+	return p, nil
+}
+
+// hostFunc is a Go callback exposed to preludes on the hidden host object.
+type hostFunc func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error)
+
+// installPolyfills registers the host functions backing the enabled polyfills
+// and queues polyfills.js to run in every context.
+func installPolyfills(c *IsolateContainer, p Polyfills) error {
+	funcs := map[string]hostFunc{}
+	if p.Timers {
+		funcs["setTimer"] = hostSetTimer
+		funcs["clearTimer"] = hostClearTimer
+	}
+	if p.Encoding {
+		funcs["utf8Encode"] = hostUTF8Encode
+		funcs["utf8Decode"] = hostUTF8Decode
+	}
+	if p.URL {
+		funcs["parseURL"] = hostParseURL
+		funcs["parseQuery"] = hostParseQuery
+		funcs["encodeQuery"] = hostEncodeQuery
+	}
+	if p.Base64 {
+		funcs["base64Encode"] = hostBase64Encode
+		funcs["base64Decode"] = hostBase64Decode
+	}
+	if p.Crypto {
+		funcs["randomBytes"] = hostRandomBytes
+		funcs["randomUUID"] = hostRandomUUID
+	}
+
+	for name, fn := range funcs {
+		if err := c.setHostFunc(name, fn); err != nil {
+			return err
+		}
+	}
+	if err := c.host.Set("microtask", p.Microtask); err != nil {
+		return err
+	}
+
+	return c.addPrelude(polyfillsPrelude, "ssr-polyfills.js")
+}
+
+func hostSetTimer(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	args := info.Args()
+	if len(args) < 3 {
+		return nil, nil
+	}
+	fn, err := args[0].AsFunction()
+	if err != nil {
+		return nil, nil
+	}
+
+	id := c.state.loop.setTimer(fn, timerDelay(args[1].Number()), args[2].Boolean())
+	return v8go.NewValue(c.Isolate, id)
+}
+
+func hostClearTimer(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	if args := info.Args(); len(args) > 0 {
+		c.state.loop.clearTimer(args[0].Int32())
+	}
+	return nil, nil
+}
+
+func hostUTF8Encode(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	return v8go.NewValue(c.Isolate, bytesToLatin1([]byte(stringArg(info, 0))))
+}
+
+// hostUTF8Decode returns null when fatal is set and the input is not valid
+// UTF-8, letting the prelude raise the TypeError.
+func hostUTF8Decode(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	data, ok := latin1ToBytes(stringArg(info, 0))
+	if !ok {
+		return v8go.Null(c.Isolate), nil
+	}
+	fatal := boolArg(info, 1)
+	ignoreBOM := boolArg(info, 2)
+
+	if !ignoreBOM {
+		data = []byte(strings.TrimPrefix(string(data), "\uFEFF"))
+	}
+	if fatal && !utf8.Valid(data) {
+		return v8go.Null(c.Isolate), nil
+	}
+	return v8go.NewValue(c.Isolate, strings.ToValidUTF8(string(data), "\uFFFD"))
+}
+
+type urlParts struct {
+	Protocol string `json:"protocol"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	Pathname string `json:"pathname"`
+	Search   string `json:"search"`
+	Hash     string `json:"hash"`
+	Origin   string `json:"origin"`
+}
+
+var specialSchemePorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"ftp":   "21",
+}
+
+// hostParseURL resolves input against base and returns the URL components as
+// JSON, or null when the result is not an absolute URL.
+func hostParseURL(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	input := strings.TrimSpace(stringArg(info, 0))
+	base := strings.TrimSpace(stringArg(info, 1))
+
+	var (
+		u   *url.URL
+		err error
+	)
+	if base != "" {
+		var b *url.URL
+		if b, err = url.Parse(base); err == nil && b.Scheme != "" {
+			u, err = b.Parse(input)
+		} else {
+			err = fmt.Errorf("invalid base %q", base)
+		}
+	} else {
+		u, err = url.Parse(input)
+	}
+	if err != nil || u.Scheme == "" {
+		return v8go.Null(c.Isolate), nil
+	}
+
+	_, special := specialSchemePorts[u.Scheme]
+	if special && u.Host == "" {
+		return v8go.Null(c.Isolate), nil
+	}
+
+	parts := urlParts{
+		Protocol: u.Scheme + ":",
+		Username: u.User.Username(),
+		Hostname: strings.ToLower(u.Hostname()),
+		Port:     u.Port(),
+		Pathname: u.EscapedPath(),
+		Origin:   "null",
+	}
+	if pw, ok := u.User.Password(); ok {
+		parts.Password = pw
+	}
+	if parts.Port == specialSchemePorts[u.Scheme] {
+		parts.Port = ""
+	}
+	if u.Opaque != "" {
+		parts.Pathname = u.Opaque
+	}
+	if special && parts.Pathname == "" {
+		parts.Pathname = "/"
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		parts.Search = "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		parts.Hash = "#" + u.EscapedFragment()
+	}
+	if special && u.Scheme != "ftp" {
+		parts.Origin = parts.Protocol + "//" + joinHostPort(parts.Hostname, parts.Port)
+	}
+
+	encoded, err := json.Marshal(parts)
+	if err != nil {
+		return nil, err
+	}
+	return v8go.NewValue(c.Isolate, string(encoded))
+}
+
+// hostParseQuery splits an application/x-www-form-urlencoded string into
+// ordered [name, value] pairs, encoded as JSON.
+func hostParseQuery(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	query := strings.TrimPrefix(stringArg(info, 0), "?")
+
+	pairs := [][2]string{}
+	for _, field := range strings.Split(query, "&") {
+		if field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		pairs = append(pairs, [2]string{unescapeQuery(name), unescapeQuery(value)})
+	}
+
+	encoded, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return v8go.NewValue(c.Isolate, string(encoded))
+}
+
+func hostEncodeQuery(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	var pairs [][2]string
+	if err := json.Unmarshal([]byte(stringArg(info, 0)), &pairs); err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		fields = append(fields, url.QueryEscape(pair[0])+"="+url.QueryEscape(pair[1]))
+	}
+	return v8go.NewValue(c.Isolate, strings.Join(fields, "&"))
+}
+
+// hostBase64Encode implements btoa; it returns null for characters outside
+// Latin-1.
+func hostBase64Encode(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	data, ok := latin1ToBytes(stringArg(info, 0))
+	if !ok {
+		return v8go.Null(c.Isolate), nil
+	}
+	return v8go.NewValue(c.Isolate, base64.StdEncoding.EncodeToString(data))
+}
+
+// hostBase64Decode implements atob; it returns null for malformed input.
+func hostBase64Decode(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	input := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\f', '\r':
+			return -1
+		}
+		return r
+	}, stringArg(info, 0))
+	input = strings.TrimRight(input, "=")
+
+	data, err := base64.RawStdEncoding.DecodeString(input)
+	if err != nil {
+		return v8go.Null(c.Isolate), nil
+	}
+	return v8go.NewValue(c.Isolate, bytesToLatin1(data))
+}
+
+func hostRandomBytes(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	n := 0
+	if args := info.Args(); len(args) > 0 {
+		n = int(args[0].Int32())
+	}
+	if n < 0 || n > 65536 {
+		return v8go.Null(c.Isolate), nil
+	}
+
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return v8go.NewValue(c.Isolate, bytesToLatin1(buf))
+}
+
+func hostRandomUUID(c *IsolateContainer, _ *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	return v8go.NewValue(c.Isolate, id)
+}
+
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+func unescapeQuery(s string) string {
+	if v, err := url.QueryUnescape(s); err == nil {
+		return v
+	}
+	return s
+}
+
+// Binary data crosses the Go/JS boundary as Latin-1 strings: one UTF-16 code
+// unit per byte, which the prelude maps to and from Uint8Array.
+
+func bytesToLatin1(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		b.WriteRune(rune(c))
+	}
+	return b.String()
+}
+
+func latin1ToBytes(s string) ([]byte, bool) {
+	data := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+		data = append(data, byte(r))
+	}
+	return data, true
+}
+
+func stringArg(info *v8go.FunctionCallbackInfo, i int) string {
+	args := info.Args()
+	if i >= len(args) || args[i].IsNullOrUndefined() {
+		return ""
+	}
+	return args[i].String()
+}
+
+func boolArg(info *v8go.FunctionCallbackInfo, i int) bool {
+	args := info.Args()
+	return i < len(args) && args[i].Boolean()
+}
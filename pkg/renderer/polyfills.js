@@ -0,0 +1,308 @@
+// Web platform polyfills for SSR contexts. Evaluates to a function that
+// receives the Go host object; only the APIs whose host functions were
+// installed are defined. Binary data crosses to Go as Latin-1 strings.
+(function (host) {
+  'use strict'
+
+  const g = globalThis
+
+  function define(name, value) {
+    Object.defineProperty(g, name, { value, writable: true, configurable: true, enumerable: false })
+  }
+
+  function latin1FromBytes(bytes) {
+    let out = ''
+    for (let i = 0; i < bytes.length; i += 8192)
+      out += String.fromCharCode.apply(null, bytes.subarray(i, i + 8192))
+    return out
+  }
+
+  function bytesFromLatin1(str) {
+    const bytes = new Uint8Array(str.length)
+    for (let i = 0; i < str.length; i++)
+      bytes[i] = str.charCodeAt(i)
+    return bytes
+  }
+
+  function toBytes(input) {
+    if (input === undefined || input === null)
+      return new Uint8Array(0)
+    if (input instanceof ArrayBuffer)
+      return new Uint8Array(input)
+    if (ArrayBuffer.isView(input))
+      return new Uint8Array(input.buffer, input.byteOffset, input.byteLength)
+    throw new TypeError('The provided value is not of type (ArrayBuffer or ArrayBufferView)')
+  }
+
+  function domError(name, message) {
+    const err = new Error(message)
+    err.name = name
+    return err
+  }
+
+  if (typeof host.setTimer === 'function') {
+    const schedule = (repeat) => (fn, delay, ...args) => {
+      const cb = typeof fn === 'function' ? () => fn(...args) : () => {}
+      return host.setTimer(cb, Number(delay) || 0, repeat)
+    }
+    const clear = (id) => {
+      if (id !== undefined && id !== null)
+        host.clearTimer(Number(id) | 0)
+    }
+    define('setTimeout', schedule(false))
+    define('setInterval', schedule(true))
+    define('clearTimeout', clear)
+    define('clearInterval', clear)
+  }
+
+  if (host.microtask) {
+    define('queueMicrotask', (cb) => {
+      if (typeof cb !== 'function')
+        throw new TypeError('queueMicrotask requires a function')
+      Promise.resolve().then(cb)
+    })
+  }
+
+  if (typeof host.utf8Encode === 'function') {
+    class TextEncoder {
+      get encoding() { return 'utf-8' }
+
+      encode(input = '') {
+        return bytesFromLatin1(host.utf8Encode(String(input)))
+      }
+
+      encodeInto(source, destination) {
+        const bytes = this.encode(source)
+        const written = Math.min(bytes.length, destination.length)
+        destination.set(bytes.subarray(0, written))
+        return { read: written === bytes.length ? String(source).length : undefined, written }
+      }
+    }
+
+    class TextDecoder {
+      #fatal
+      #ignoreBOM
+
+      constructor(label = 'utf-8', options = {}) {
+        const normalized = String(label).trim().toLowerCase()
+        if (normalized !== 'utf-8' && normalized !== 'utf8' && normalized !== 'unicode-1-1-utf-8')
+          throw new RangeError(`The encoding label provided ('${label}') is not supported`)
+        this.#fatal = !!options.fatal
+        this.#ignoreBOM = !!options.ignoreBOM
+      }
+
+      get encoding() { return 'utf-8' }
+      get fatal() { return this.#fatal }
+      get ignoreBOM() { return this.#ignoreBOM }
+
+      decode(input) {
+        const out = host.utf8Decode(latin1FromBytes(toBytes(input)), this.#fatal, this.#ignoreBOM)
+        if (out === null)
+          throw new TypeError('The encoded data was not valid UTF-8')
+        return out
+      }
+    }
+
+    define('TextEncoder', TextEncoder)
+    define('TextDecoder', TextDecoder)
+  }
+
+  if (typeof host.parseURL === 'function') {
+    class URLSearchParams {
+      #pairs = []
+      #onChange = null
+
+      constructor(init = '') {
+        if (init instanceof URLSearchParams) {
+          this.#pairs = init.#pairs.map(([k, v]) => [k, v])
+        }
+        else if (typeof init === 'object' && init !== null) {
+          const entries = typeof init[Symbol.iterator] === 'function' ? init : Object.entries(init)
+          for (const pair of entries) {
+            const [k, v] = Array.from(pair)
+            this.#pairs.push([String(k), String(v)])
+          }
+        }
+        else {
+          this.#pairs = JSON.parse(host.parseQuery(String(init)))
+        }
+      }
+
+      static _attach(params, query, onChange) {
+        params.#pairs = JSON.parse(host.parseQuery(query))
+        params.#onChange = onChange
+      }
+
+      #update() {
+        if (this.#onChange)
+          this.#onChange(this.toString())
+      }
+
+      get size() { return this.#pairs.length }
+
+      append(name, value) {
+        this.#pairs.push([String(name), String(value)])
+        this.#update()
+      }
+
+      delete(name, value) {
+        name = String(name)
+        this.#pairs = this.#pairs.filter(([k, v]) => k !== name || (value !== undefined && v !== String(value)))
+        this.#update()
+      }
+
+      get(name) {
+        const found = this.#pairs.find(([k]) => k === String(name))
+        return found ? found[1] : null
+      }
+
+      getAll(name) {
+        return this.#pairs.filter(([k]) => k === String(name)).map(([, v]) => v)
+      }
+
+      has(name, value) {
+        return this.#pairs.some(([k, v]) => k === String(name) && (value === undefined || v === String(value)))
+      }
+
+      set(name, value) {
+        name = String(name)
+        const index = this.#pairs.findIndex(([k]) => k === name)
+        if (index === -1) {
+          this.#pairs.push([name, String(value)])
+        }
+        else {
+          this.#pairs[index][1] = String(value)
+          this.#pairs = this.#pairs.filter(([k], i) => k !== name || i <= index)
+        }
+        this.#update()
+      }
+
+      sort() {
+        this.#pairs.sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0))
+        this.#update()
+      }
+
+      forEach(callback, thisArg) {
+        for (const [k, v] of this.#pairs)
+          callback.call(thisArg, v, k, this)
+      }
+
+      * keys() { for (const [k] of this.#pairs) yield k }
+      * values() { for (const [, v] of this.#pairs) yield v }
+      * entries() { for (const [k, v] of this.#pairs) yield [k, v] }
+      [Symbol.iterator]() { return this.entries() }
+
+      toString() {
+        return host.encodeQuery(JSON.stringify(this.#pairs))
+      }
+    }
+
+    const attachParams = URLSearchParams._attach
+    delete URLSearchParams._attach
+
+    class URL {
+      #parts
+      #searchParams
+
+      constructor(input, base) {
+        this.#parse(String(input), base === undefined ? '' : String(base))
+      }
+
+      static canParse(input, base) {
+        return host.parseURL(String(input), base === undefined ? '' : String(base)) !== null
+      }
+
+      #parse(input, base) {
+        const parsed = host.parseURL(input, base)
+        if (parsed === null)
+          throw new TypeError(`Invalid URL: ${input}`)
+        this.#parts = JSON.parse(parsed)
+        this.#searchParams ??= new URLSearchParams()
+        attachParams(this.#searchParams, this.#parts.search, (query) => {
+          this.#parts.search = query ? `?${query}` : ''
+        })
+      }
+
+      #reparse() {
+        this.#parse(this.href, '')
+      }
+
+      get href() {
+        const p = this.#parts
+        const auth = p.username ? `${p.username}${p.password ? `:${p.password}` : ''}@` : ''
+        const authority = p.hostname ? `//${auth}${this.host}` : ''
+        return `${p.protocol}${authority}${p.pathname}${p.search}${p.hash}`
+      }
+
+      set href(value) { this.#parse(String(value), '') }
+      get origin() { return this.#parts.origin }
+      get protocol() { return this.#parts.protocol }
+      get username() { return this.#parts.username }
+      get password() { return this.#parts.password }
+      get host() { return this.#parts.port ? `${this.#parts.hostname}:${this.#parts.port}` : this.#parts.hostname }
+      get hostname() { return this.#parts.hostname }
+      get port() { return this.#parts.port }
+      get pathname() { return this.#parts.pathname }
+      get search() { return this.#parts.search.length > 1 ? this.#parts.search : '' }
+      get hash() { return this.#parts.hash.length > 1 ? this.#parts.hash : '' }
+      get searchParams() { return this.#searchParams }
+
+      set pathname(value) {
+        value = String(value)
+        this.#parts.pathname = value.startsWith('/') ? value : `/${value}`
+        this.#reparse()
+      }
+
+      set search(value) {
+        value = String(value)
+        this.#parts.search = value && !value.startsWith('?') ? `?${value}` : value
+        this.#reparse()
+      }
+
+      set hash(value) {
+        value = String(value)
+        this.#parts.hash = value && !value.startsWith('#') ? `#${value}` : value
+      }
+
+      toString() { return this.href }
+      toJSON() { return this.href }
+    }
+
+    define('URL', URL)
+    define('URLSearchParams', URLSearchParams)
+  }
+
+  if (typeof host.base64Encode === 'function') {
+    define('btoa', (data) => {
+      const out = host.base64Encode(String(data))
+      if (out === null)
+        throw domError('InvalidCharacterError', 'The string to be encoded contains characters outside of the Latin1 range.')
+      return out
+    })
+    define('atob', (data) => {
+      const out = host.base64Decode(String(data))
+      if (out === null)
+        throw domError('InvalidCharacterError', 'The string to be decoded is not correctly encoded.')
+      return out
+    })
+  }
+
+  if (typeof host.randomBytes === 'function') {
+    const crypto = {
+      getRandomValues(array) {
+        if (!ArrayBuffer.isView(array) || array instanceof Float32Array || array instanceof Float64Array || array instanceof DataView)
+          throw new TypeError('The provided value is not an integer-typed array')
+        const bytes = host.randomBytes(array.byteLength)
+        if (bytes === null)
+          throw domError('QuotaExceededError', `The ArrayBufferView's byte length (${array.byteLength}) exceeds the number of bytes of entropy available via this API (65536)`)
+        new Uint8Array(array.buffer, array.byteOffset, array.byteLength).set(bytesFromLatin1(bytes))
+        return array
+      },
+      randomUUID() {
+        return host.randomUUID()
+      },
+    }
+    if (typeof g.crypto === 'undefined')
+      define('crypto', crypto)
+  }
+})
@@ -0,0 +1,83 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func renderWithPolyfills(t *testing.T, src string) string {
+	t.Helper()
+	r, err := NewRenderer(serverBundle(src), "server.js", WithPolyfills(AllPolyfills()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+
+	res, err := r.Render(context.Background(), "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.HTML
+}
+
+func TestTimerDelay(t *testing.T) {
+	for _, tt := range []struct {
+		ms   float64
+		want time.Duration
+	}{
+		{10, 10 * time.Millisecond},
+		{0.5, 500 * time.Microsecond},
+		{0, 0},
+		{-5, 0},
+		{math.NaN(), 0},
+		{math.Inf(-1), 0},
+		{math.Inf(1), maxTimerDelay},
+		{1e300, maxTimerDelay},
+	} {
+		if got := timerDelay(tt.ms); got != tt.want {
+			t.Errorf("timerDelay(%v) = %v, want %v", tt.ms, got, tt.want)
+		}
+	}
+}
+
+func TestEventLoopOrder(t *testing.T) {
+	got := renderWithPolyfills(t, `globalThis.ssrRender = () => new Promise((resolve) => {
+  const log = []
+  setTimeout(() => log.push("t10"), 10)
+  setTimeout(() => log.push("nan"), NaN)
+  setTimeout(() => log.push("neg"), -5)
+  setTimeout(() => log.push("never"), Infinity)
+  clearTimeout(setTimeout(() => log.push("cleared"), 0))
+  let n = 0
+  const interval = setInterval(() => {
+    log.push("i" + ++n)
+    if (n === 2) clearInterval(interval)
+  }, 0)
+  queueMicrotask(() => log.push("micro"))
+  Promise.resolve().then(() => log.push("then"))
+  log.push("sync")
+  setTimeout(() => resolve(log.join(",")), 30)
+})`)
+
+	if want := "sync,micro,then,nan,neg,i1,i2,t10"; got != want {
+		t.Fatalf("event loop ran %s, want %s", got, want)
+	}
+}
+
+func TestTextEncoding(t *testing.T) {
+	got := renderWithPolyfills(t, `globalThis.ssrRender = () => {
+  const bytes = new TextEncoder().encode("é€")
+  let invalid = "accepted"
+  try { new TextDecoder("utf-8", { fatal: true }).decode(new Uint8Array([0xff])) }
+  catch (err) { invalid = err.name }
+  return [Array.from(bytes).join(" "), new TextDecoder().decode(bytes), invalid].join("|")
+}`)
+
+	if want := "195 169 226 130 172|é€|TypeError"; got != want {
+		t.Fatalf("encoding = %q, want %q", got, want)
+	}
+}
@@ -1,56 +1,649 @@
+//go:build cgo
+
 package renderer
 
 import (
-	"rogchap.com/v8go"
-	"runtime"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"rogchap.com/v8go"
 )
 
+var ErrPoolClosed = errors.New("isolate pool closed")
+
+// ErrHeapLimit fails a render whose isolate used more heap than
+// PoolOptions.HeapLimit allows.
+var ErrHeapLimit = errors.New("isolate heap limit exceeded")
+
+// PoolOptions bounds the isolate pool and controls when isolates are recycled.
+// Zero values mean "no limit".
+type PoolOptions struct {
+	// MinIsolates are created eagerly and kept alive after recycling.
+	MinIsolates int
+	// MaxIsolates caps idle plus busy isolates; Get blocks once reached.
+	MaxIsolates int
+	// MaxRendersPerIsolate recycles an isolate after this many renders.
+	MaxRendersPerIsolate int
+	// MaxIsolateAge recycles an isolate once it is older than this.
+	MaxIsolateAge time.Duration
+	// MaxHeapSize recycles an isolate after a render that leaves more than
+	// this many bytes of used V8 heap.
+	MaxHeapSize uint64
+	// MaxHeapGrowth recycles an isolate once its used heap has grown by
+	// more than this many bytes since its first render, e.g. through
+	// module-level caches of the bundle.
+	MaxHeapGrowth uint64
+	// HeapLimit fails a render with ErrHeapLimit once its isolate uses more
+	// than this many bytes of heap, and discards the isolate. v8go cannot
+	// set V8's own heap limit, so this is checked between the tasks of a
+	// render and when it returns: synchronous code allocating past V8's
+	// limit (HeapStats.Limit) still aborts the process.
+	HeapLimit uint64
+	// CodeCacheDir, when set, persists the entry's V8 code cache across
+	// restarts, keyed by a hash of the bundle.
+	CodeCacheDir string
+}
+
+// PoolStats is a point-in-time snapshot of the pool.
+type PoolStats struct {
+	Idle      int    `json:"idle"`
+	Busy      int    `json:"busy"`
+	Created   uint64 `json:"created"`
+	Destroyed uint64 `json:"destroyed"`
+	// Queued and Workers are reported by renderers that render on workers;
+	// see WithWorkers.
+	Queued  int           `json:"queued,omitempty"`
+	Workers []WorkerStats `json:"workers,omitempty"`
+	// Isolates describes every isolate of the pool, oldest first.
+	Isolates []IsolateStats `json:"isolates"`
+}
+
+// IsolateStats describes one isolate. Heap is sampled after each render and
+// is zero until the first one.
+type IsolateStats struct {
+	Busy       bool      `json:"busy"`
+	Renders    int       `json:"renders"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	Heap       HeapStats `json:"heap"`
+}
+
+// HeapStats is the part of v8go.HeapStatistics worth watching, in bytes.
+type HeapStats struct {
+	Used  uint64 `json:"used"`
+	Total uint64 `json:"total"`
+	// Limit is V8's own heap limit, past which the process aborts.
+	Limit    uint64 `json:"limit"`
+	External uint64 `json:"external"`
+	Malloced uint64 `json:"malloced"`
+	// Growth is Used minus the used heap after the first render.
+	Growth           int64  `json:"growth"`
+	NativeContexts   uint64 `json:"nativeContexts"`
+	DetachedContexts uint64 `json:"detachedContexts"`
+}
+
+// IsolateSetup prepares a freshly created isolate, e.g. by building the
+// global template that host bindings are installed on.
+type IsolateSetup func(*IsolateContainer) error
+
 type IsolatePool struct {
-	pool *sync.Pool
+	bundle *bundle
+	opts   PoolOptions
+	setup  IsolateSetup
+
+	// codeCaches holds one V8 code cache per module, produced by the first
+	// compile and consumed by later ones. They are refreshed once after the
+	// first render so that lazily compiled functions are included too.
+	codeCacheMu     sync.RWMutex
+	codeCaches      map[string][]byte
+	codeCacheWarmed atomic.Bool
+
+	// slots holds one token per busy isolate when MaxIsolates is set.
+	slots chan struct{}
+
+	mu        sync.Mutex
+	idle      []*IsolateContainer
+	live      map[*IsolateContainer]struct{}
+	busy      int
+	created   uint64
+	destroyed uint64
+	closed    bool
+
+	replenishing bool
 }
 
 type IsolateContainer struct {
-	Isolate      *v8go.Isolate
+	Isolate *v8go.Isolate
+	// RenderScript is the bundle entry, wrapped as a CommonJS module.
 	RenderScript *v8go.UnboundScript
+	// Global is the template every render context is created from.
+	Global *v8go.ObjectTemplate
+
+	pool    *IsolatePool
+	modules map[string]*v8go.UnboundScript
+
+	console *v8go.ObjectTemplate
+	// host holds Go callbacks for preludes; see host.go.
+	host     *v8go.ObjectTemplate
+	preludes []*v8go.UnboundScript
+
+	createdAt time.Time
+	renders   int
+	// heap is sampled after every render and heapBase is the used heap
+	// after the first one. Both are written under the pool's mu.
+	heap     v8go.HeapStatistics
+	heapBase uint64
+
+	// state belongs to the render currently running on this isolate. Host
+	// callbacks are bound once per isolate and read it on every call.
+	state *renderState
 }
 
-func NewIsolatePool(ssrScriptContents string, ssrScriptName string) *IsolatePool {
-	return &IsolatePool{
-		pool: newIsolatePool(ssrScriptContents, ssrScriptName),
+// NewIsolatePool compiles the bundle entry into MinIsolates isolates (at
+// least one, so a broken bundle is reported here rather than on the first
+// request). Other modules are compiled when first required.
+func NewIsolatePool(serverDist fs.FS, entry string, opts PoolOptions, setup IsolateSetup) (*IsolatePool, error) {
+	if opts.MaxIsolates > 0 && opts.MinIsolates > opts.MaxIsolates {
+		opts.MinIsolates = opts.MaxIsolates
 	}
-}
 
-func newIsolatePool(ssrScriptContents string, ssrScriptName string) *sync.Pool {
-	return &sync.Pool{
-		New: func() interface{} {
-			isolate := v8go.NewIsolate()
-			script, _ := isolate.CompileUnboundScript(ssrScriptContents, ssrScriptName, v8go.CompileOptions{})
+	b, err := loadBundle(serverDist, entry)
+	if err != nil {
+		return nil, err
+	}
 
-			runtime.SetFinalizer(isolate, func(iso *v8go.Isolate) {
-				if iso != nil {
-					iso.Dispose()
-				}
-			})
+	p := &IsolatePool{
+		bundle:     b,
+		opts:       opts,
+		setup:      setup,
+		codeCaches: map[string][]byte{},
+		live:       map[*IsolateContainer]struct{}{},
+	}
+	if opts.MaxIsolates > 0 {
+		p.slots = make(chan struct{}, opts.MaxIsolates)
+	}
+	if cached := p.loadCodeCache(); cached != nil {
+		p.codeCaches[b.entry] = cached
+	}
 
-			return &IsolateContainer{
-				Isolate:      isolate,
-				RenderScript: script,
-			}
-		},
+	eager := max(opts.MinIsolates, 1)
+	for range eager {
+		container, err := p.newContainer()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, container)
 	}
+	trackPool(p)
+
+	return p, nil
 }
 
-func (p *IsolatePool) Get() *IsolateContainer {
-	item := p.pool.Get()
-	isolate, ok := item.(*IsolateContainer)
-	if !ok {
-		panic(item.(error))
+func (p *IsolatePool) newContainer() (*IsolateContainer, error) {
+	isolate := v8go.NewIsolate()
+	script, err := p.compile(isolate, p.bundle.entry)
+	if err != nil {
+		isolate.Dispose()
+		return nil, err
 	}
 
-	return isolate
+	container := &IsolateContainer{
+		Isolate:      isolate,
+		RenderScript: script,
+		Global:       v8go.NewObjectTemplate(isolate),
+		pool:         p,
+		modules:      map[string]*v8go.UnboundScript{p.bundle.entry: script},
+		host:         v8go.NewObjectTemplate(isolate),
+		createdAt:    time.Now(),
+	}
+	if err := container.Global.Set(hostObjectName, container.host); err != nil {
+		isolate.Dispose()
+		return nil, err
+	}
+	if p.setup != nil {
+		if err := p.setup(container); err != nil {
+			isolate.Dispose()
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	p.created++
+	p.live[container] = struct{}{}
+	p.mu.Unlock()
+	isolatesCreated.Inc()
+
+	return container, nil
 }
 
+// Get returns an idle isolate or creates a new one, waiting for a free slot
+// when MaxIsolates busy isolates are already handed out.
+func (p *IsolatePool) Get(ctx context.Context) (*IsolateContainer, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrQueueWait, ctx.Err())
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.releaseSlot()
+		return nil, ErrPoolClosed
+	}
+	p.busy++
+	if n := len(p.idle); n > 0 {
+		container := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return container, nil
+	}
+	p.mu.Unlock()
+
+	container, err := p.newContainer()
+	if err != nil {
+		p.mu.Lock()
+		p.busy--
+		p.mu.Unlock()
+		p.releaseSlot()
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// Put returns an isolate to the pool, recycling it when it has reached the
+// render or age limit.
 func (p *IsolatePool) Put(isolateContainer *IsolateContainer) {
-	p.pool.Put(isolateContainer)
+	if p.renew(isolateContainer) {
+		p.release(isolateContainer)
+	}
+}
+
+// renew counts a finished render and samples the heap, recycling the
+// isolate when it has reached the render, age or heap limit. It reports
+// whether the caller still holds the isolate.
+func (p *IsolatePool) renew(isolateContainer *IsolateContainer) bool {
+	heap := isolateContainer.Isolate.GetHeapStatistics()
+	isolateHeapUsed.Observe(float64(heap.UsedHeapSize))
+
+	p.mu.Lock()
+	isolateContainer.renders++
+	isolateContainer.heap = heap
+	if isolateContainer.renders == 1 {
+		isolateContainer.heapBase = heap.UsedHeapSize
+	}
+	p.mu.Unlock()
+
+	if p.codeCacheWarmed.CompareAndSwap(false, true) {
+		for name, script := range isolateContainer.modules {
+			p.storeCodeCache(name, script.CreateCodeCache())
+		}
+	}
+
+	if reason := p.recycleReason(isolateContainer); reason != "" {
+		p.discard(isolateContainer, reason)
+		return false
+	}
+	return true
+}
+
+// release makes a busy isolate idle again.
+func (p *IsolatePool) release(isolateContainer *IsolateContainer) {
+	p.mu.Lock()
+	p.busy--
+	overflow := p.opts.MaxIsolates > 0 && len(p.idle)+p.busy >= p.opts.MaxIsolates
+	if p.closed || overflow {
+		closed := p.closed
+		p.mu.Unlock()
+		if !closed {
+			isolatesRecycled.WithLabelValues(recycleOverflow).Inc()
+		}
+		p.dispose(isolateContainer)
+		p.releaseSlot()
+		return
+	}
+	p.idle = append(p.idle, isolateContainer)
+	p.mu.Unlock()
+	p.releaseSlot()
+}
+
+// Discard disposes an isolate that must not be reused, e.g. after its
+// execution was terminated.
+func (p *IsolatePool) Discard(isolateContainer *IsolateContainer) {
+	p.discard(isolateContainer, recycleTerminated)
+}
+
+func (p *IsolatePool) discard(isolateContainer *IsolateContainer, reason string) {
+	p.mu.Lock()
+	p.busy--
+	closed := p.closed
+	p.mu.Unlock()
+
+	if !closed {
+		isolatesRecycled.WithLabelValues(reason).Inc()
+	}
+	p.dispose(isolateContainer)
+	p.releaseSlot()
+
+	if !closed {
+		go p.replenish()
+	}
+}
+
+// Close disposes every idle isolate. Busy isolates are disposed when they
+// are returned.
+func (p *IsolatePool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	untrackPool(p)
+
+	for _, container := range idle {
+		p.dispose(container)
+	}
+}
+
+func (p *IsolatePool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := make(map[*IsolateContainer]bool, len(p.idle))
+	for _, container := range p.idle {
+		idle[container] = true
+	}
+	isolates := make([]*IsolateContainer, 0, len(p.live))
+	for container := range p.live {
+		isolates = append(isolates, container)
+	}
+	slices.SortFunc(isolates, func(a, b *IsolateContainer) int { return a.createdAt.Compare(b.createdAt) })
+
+	stats := PoolStats{
+		Idle:      len(p.idle),
+		Busy:      p.busy,
+		Created:   p.created,
+		Destroyed: p.destroyed,
+		Isolates:  make([]IsolateStats, 0, len(isolates)),
+	}
+	for _, container := range isolates {
+		heap := container.heap
+		stats.Isolates = append(stats.Isolates, IsolateStats{
+			Busy:       !idle[container],
+			Renders:    container.renders,
+			AgeSeconds: time.Since(container.createdAt).Seconds(),
+			Heap: HeapStats{
+				Used:             heap.UsedHeapSize,
+				Total:            heap.TotalHeapSize,
+				Limit:            heap.HeapSizeLimit,
+				External:         heap.ExternalMemory,
+				Malloced:         heap.MallocedMemory,
+				Growth:           int64(heap.UsedHeapSize) - int64(container.heapBase),
+				NativeContexts:   heap.NumberOfNativeContexts,
+				DetachedContexts: heap.NumberOfDetachedContexts,
+			},
+		})
+	}
+	return stats
+}
+
+// recycleReason reports why an isolate has to be recycled, or "" when it can
+// be reused.
+func (p *IsolatePool) recycleReason(isolateContainer *IsolateContainer) string {
+	if p.opts.MaxRendersPerIsolate > 0 && isolateContainer.renders >= p.opts.MaxRendersPerIsolate {
+		return recycleMaxRenders
+	}
+	if p.opts.MaxIsolateAge > 0 && time.Since(isolateContainer.createdAt) >= p.opts.MaxIsolateAge {
+		return recycleMaxAge
+	}
+	used := isolateContainer.heap.UsedHeapSize
+	if p.opts.MaxHeapSize > 0 && used > p.opts.MaxHeapSize {
+		return recycleHeapSize
+	}
+	if p.opts.MaxHeapGrowth > 0 && used > isolateContainer.heapBase+p.opts.MaxHeapGrowth {
+		return recycleHeapGrowth
+	}
+	return ""
+}
+
+// checkHeap fails with ErrHeapLimit once isolate uses more than limit bytes
+// of heap; 0 means no limit.
+func checkHeap(isolate *v8go.Isolate, limit uint64) error {
+	if limit == 0 {
+		return nil
+	}
+	if used := isolate.GetHeapStatistics().UsedHeapSize; used > limit {
+		return fmt.Errorf("%w: %d MiB used, limit %d MiB", ErrHeapLimit, used>>20, limit>>20)
+	}
+	return nil
+}
+
+// replenish tops the pool back up to MinIsolates after a recycle.
+func (p *IsolatePool) replenish() {
+	p.mu.Lock()
+	if p.replenishing {
+		p.mu.Unlock()
+		return
+	}
+	p.replenishing = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.replenishing = false
+		p.mu.Unlock()
+	}()
+
+	for {
+		p.mu.Lock()
+		short := !p.closed && len(p.idle)+p.busy < p.opts.MinIsolates
+		p.mu.Unlock()
+		if !short {
+			return
+		}
+
+		container, err := p.newContainer()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.dispose(container)
+			return
+		}
+		p.idle = append(p.idle, container)
+		p.mu.Unlock()
+	}
+}
+
+func (p *IsolatePool) dispose(isolateContainer *IsolateContainer) {
+	if isolateContainer == nil || isolateContainer.Isolate == nil {
+		return
+	}
+	isolateContainer.Isolate.Dispose()
+
+	p.mu.Lock()
+	delete(p.live, isolateContainer)
+	p.destroyed++
+	p.mu.Unlock()
+}
+
+// compile compiles a bundle module for isolate, consuming the module's code
+// cache when one exists.
+func (p *IsolatePool) compile(isolate *v8go.Isolate, name string) (*v8go.UnboundScript, error) {
+	src, err := p.bundle.source(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.codeCacheMu.RLock()
+	cached := p.codeCaches[name]
+	p.codeCacheMu.RUnlock()
+
+	compileOpts := v8go.CompileOptions{}
+	if len(cached) > 0 {
+		compileOpts.CachedData = &v8go.CompilerCachedData{Bytes: cached}
+	}
+
+	script, err := isolate.CompileUnboundScript(src, name, compileOpts)
+	if err != nil {
+		return nil, formatError(err)
+	}
+
+	// A missing or rejected cache (e.g. after a V8 upgrade) is regenerated
+	// from the script that was just compiled from source.
+	if compileOpts.CachedData == nil || compileOpts.CachedData.Rejected {
+		p.storeCodeCache(name, script.CreateCodeCache())
+	}
+
+	return script, nil
+}
+
+// module returns the compiled module, compiling it on first use.
+func (c *IsolateContainer) module(name string) (*v8go.UnboundScript, error) {
+	if script, ok := c.modules[name]; ok {
+		return script, nil
+	}
+
+	script, err := c.pool.compile(c.Isolate, name)
+	if err != nil {
+		return nil, err
+	}
+	c.modules[name] = script
+	return script, nil
+}
+
+func (p *IsolatePool) codeCachePath() string {
+	if p.opts.CodeCacheDir == "" {
+		return ""
+	}
+	name := fmt.Sprintf("%s-%s.v8cache", filepath.Base(p.bundle.entry), p.bundle.hash[:16])
+	return filepath.Join(p.opts.CodeCacheDir, name)
+}
+
+func (p *IsolatePool) loadCodeCache() []byte {
+	path := p.codeCachePath()
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// storeCodeCache keeps a module's code cache in memory; the entry's cache is
+// also written to CodeCacheDir.
+func (p *IsolatePool) storeCodeCache(name string, cache *v8go.CompilerCachedData) {
+	if cache == nil || cache.Rejected || len(cache.Bytes) == 0 {
+		return
+	}
+
+	p.codeCacheMu.Lock()
+	p.codeCaches[name] = cache.Bytes
+	p.codeCacheMu.Unlock()
+
+	path := p.codeCachePath()
+	if path == "" || name != p.bundle.entry {
+		return
+	}
+	if err := writeFileAtomic(path, cache.Bytes); err != nil {
+		log.Printf("ssr code cache write failed path=%s err=%v", path, err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (p *IsolatePool) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// livePools feeds the pool size gauges; every open pool is counted.
+var livePools = struct {
+	sync.Mutex
+	pools map[*IsolatePool]struct{}
+}{pools: map[*IsolatePool]struct{}{}}
+
+func init() {
+	for _, state := range []string{"idle", "busy"} {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "ssr",
+			Name:        "isolates",
+			Help:        "V8 isolates held by open SSR isolate pools, by state.",
+			ConstLabels: prometheus.Labels{"state": state},
+		}, func() float64 {
+			idle, busy := livePoolTotals()
+			if state == "idle" {
+				return float64(idle)
+			}
+			return float64(busy)
+		})
+	}
+}
+
+func trackPool(p *IsolatePool) {
+	livePools.Lock()
+	livePools.pools[p] = struct{}{}
+	livePools.Unlock()
+}
+
+func untrackPool(p *IsolatePool) {
+	livePools.Lock()
+	delete(livePools.pools, p)
+	livePools.Unlock()
+}
+
+func livePoolTotals() (idle, busy int) {
+	livePools.Lock()
+	defer livePools.Unlock()
+
+	for p := range livePools.pools {
+		stats := p.Stats()
+		idle += stats.Idle
+		busy += stats.Busy
+	}
+	return idle, busy
 }
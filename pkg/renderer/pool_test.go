@@ -0,0 +1,137 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// serverBundle is a server build whose entry is server.js with src.
+func serverBundle(src string) fstest.MapFS {
+	return fstest.MapFS{"server.js": {Data: []byte(src)}}
+}
+
+func newTestPool(t *testing.T, opts PoolOptions) *IsolatePool {
+	t.Helper()
+	pool, err := NewIsolatePool(serverBundle(`globalThis.ssrRender = (p) => p`), "server.js", opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func getIsolate(t *testing.T, pool *IsolatePool) *IsolateContainer {
+	t.Helper()
+	iso, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iso
+}
+
+func TestPoolReusesIsolates(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MaxIsolates: 1})
+
+	first := getIsolate(t, pool)
+	pool.Put(first)
+	if second := getIsolate(t, pool); second != first {
+		t.Fatal("Get did not reuse the idle isolate")
+	}
+	if stats := pool.Stats(); stats.Created != 1 || stats.Destroyed != 0 {
+		t.Fatalf("created %d destroyed %d isolates, want 1 and 0", stats.Created, stats.Destroyed)
+	}
+}
+
+func TestPoolRecyclesAfterMaxRenders(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MaxIsolates: 1, MaxRendersPerIsolate: 2})
+
+	first := getIsolate(t, pool)
+	pool.Put(first)
+	if iso := getIsolate(t, pool); iso != first {
+		t.Fatal("isolate recycled before reaching MaxRendersPerIsolate")
+	}
+	pool.Put(first)
+
+	if iso := getIsolate(t, pool); iso == first {
+		t.Fatal("isolate reused after MaxRendersPerIsolate renders")
+	}
+	if destroyed := pool.Stats().Destroyed; destroyed != 1 {
+		t.Fatalf("destroyed %d isolates, want 1", destroyed)
+	}
+}
+
+func TestPoolRecyclesByAge(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MaxIsolates: 1, MaxIsolateAge: 20 * time.Millisecond})
+
+	first := getIsolate(t, pool)
+	pool.Put(first)
+	if iso := getIsolate(t, pool); iso != first {
+		t.Fatal("young isolate was recycled")
+	}
+	time.Sleep(30 * time.Millisecond)
+	pool.Put(first)
+
+	if iso := getIsolate(t, pool); iso == first {
+		t.Fatal("isolate reused after MaxIsolateAge")
+	}
+}
+
+func TestPoolDiscard(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MaxIsolates: 1})
+
+	first := getIsolate(t, pool)
+	pool.Discard(first)
+	if iso := getIsolate(t, pool); iso == first {
+		t.Fatal("discarded isolate was reused")
+	}
+}
+
+func TestPoolGetWaitsForSlot(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MaxIsolates: 1})
+	iso := getIsolate(t, pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get with every slot busy returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	pool.Put(iso)
+	getIsolate(t, pool)
+}
+
+func TestPoolReplenishesMinIsolates(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{MinIsolates: 2, MaxIsolates: 2, MaxRendersPerIsolate: 1})
+	if idle := pool.Stats().Idle; idle != 2 {
+		t.Fatalf("%d idle isolates after start, want 2", idle)
+	}
+
+	pool.Put(getIsolate(t, pool))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats().Idle < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool was not replenished: %+v", pool.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	pool := newTestPool(t, PoolOptions{})
+	iso := getIsolate(t, pool)
+	pool.Close()
+
+	if _, err := pool.Get(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Get after Close returned %v, want %v", err, ErrPoolClosed)
+	}
+	pool.Put(iso)
+	if stats := pool.Stats(); stats.Busy != 0 || stats.Idle != 0 || stats.Destroyed != stats.Created {
+		t.Fatalf("isolates left after Close: %+v", stats)
+	}
+}
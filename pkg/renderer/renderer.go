@@ -1,42 +1,299 @@
+//go:build cgo
+
 package renderer
 
 import (
+	"context"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"net/http"
 	"strconv"
+	"sync/atomic"
 
 	"rogchap.com/v8go"
 )
 
-// Renderer renders a React application to HTML.
+// Renderer renders server.js to HTML in embedded V8 isolates.
 type Renderer struct {
 	pool          *IsolatePool
 	ssrScriptName string
+	opts          options
+	// functions are the Go functions registered when the renderer started.
+	functions map[string]*hostFunction
+	// workers is set by WithWorkers.
+	workers *renderWorkers
+}
+
+type Option func(*options)
+
+type options struct {
+	pool            PoolOptions
+	consoleMaxLines int
+	polyfills       Polyfills
+
+	fetchHandler http.Handler
+	fetch        FetchOptions
+
+	workers int
+}
+
+// WithPoolOptions configures the size and recycling policy of the isolate pool.
+func WithPoolOptions(opts PoolOptions) Option {
+	return func(o *options) {
+		o.pool = opts
+	}
+}
+
+// WithPolyfills selects the web platform APIs available to server.js.
+// All of them are enabled by default.
+func WithPolyfills(p Polyfills) Option {
+	return func(o *options) {
+		o.polyfills = p
+	}
+}
+
+// WithFetch installs a fetch() that serves same-origin requests with handler
+// in-process instead of going over the network.
+func WithFetch(handler http.Handler, opts FetchOptions) Option {
+	return func(o *options) {
+		o.fetchHandler = handler
+		o.fetch = opts
+	}
+}
+
+// WithWorkers renders on n workers, each pinned to an OS thread and keeping
+// its isolate from render to render, instead of handing a pooled isolate to
+// the goroutine of every render. Renders wait for a worker in a queue
+// ordered by their priority (see WithPriority), then by their deadline;
+// WithQueueBudget caps the wait.
+// MaxIsolates is raised to n if it is lower; the workers' isolates count
+// as busy.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithConsoleLineLimit caps how many console lines a single render may log.
+func WithConsoleLineLimit(n int) Option {
+	return func(o *options) {
+		o.consoleMaxLines = n
+	}
+}
+
+// NewRenderer creates a new server side renderer for the bundle in
+// serverDist. entry is loaded as a CommonJS module and may require() other
+// files of the bundle. It returns an error when the entry fails to compile.
+func NewRenderer(serverDist fs.FS, entry string, opts ...Option) (*Renderer, error) {
+	o := options{
+		consoleMaxLines: defaultConsoleMaxLines,
+		polyfills:       AllPolyfills(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers > 0 && o.pool.MaxIsolates > 0 && o.pool.MaxIsolates < o.workers {
+		o.pool.MaxIsolates = o.workers
+	}
+
+	r := &Renderer{
+		ssrScriptName: entry,
+		opts:          o,
+		functions:     registeredFunctions(),
+	}
+
+	pool, err := NewIsolatePool(serverDist, entry, o.pool, r.setupIsolate)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", entry, err)
+	}
+	r.pool = pool
+	r.ssrScriptName = pool.bundle.entry
+	if o.workers > 0 {
+		r.workers = startWorkers(r, o.workers)
+	}
+
+	return r, nil
+}
+
+// setupIsolate installs the host bindings on a new isolate's global template.
+func (r *Renderer) setupIsolate(c *IsolateContainer) error {
+	if err := installConsole(c); err != nil {
+		return err
+	}
+	if err := installRequire(c); err != nil {
+		return err
+	}
+	if err := installPolyfills(c, r.opts.polyfills); err != nil {
+		return err
+	}
+	if err := installResponse(c); err != nil {
+		return err
+	}
+	if err := installStream(c); err != nil {
+		return err
+	}
+	if err := installFunctions(c, r.functions); err != nil {
+		return err
+	}
+	if r.opts.fetchHandler != nil {
+		return installFetch(c, r.opts.fetchHandler, r.opts.fetch)
+	}
+	return nil
 }
 
-type Result struct {
-	HTML string
-	Head string
+// Stats reports the current state of the isolate pool.
+func (r *Renderer) Stats() PoolStats {
+	stats := r.pool.Stats()
+	if r.workers != nil {
+		r.workers.stats(&stats)
+	}
+	return stats
+}
+
+// BundleHash returns the SHA-256 fingerprint of the server bundle, covering
+// the entry and every chunk.
+func (r *Renderer) BundleHash() string {
+	return r.pool.bundle.hash
 }
 
-// NewRenderer creates a new server side renderer for a given script.
-func NewRenderer(scriptContents string) *Renderer {
-	ssrScriptName := "server.js"
+// Close disposes all isolates owned by the renderer. The workers stop
+// first, failing queued renders and handing back their isolates, so the
+// pool can dispose of them.
+func (r *Renderer) Close() {
+	if r.workers != nil {
+		r.workers.close()
+	}
+	r.pool.Close()
+}
 
-	return &Renderer{
-		pool:          NewIsolatePool(scriptContents, ssrScriptName),
-		ssrScriptName: ssrScriptName,
+// Workers returns the number of render workers set by WithWorkers, or 0
+// when every render borrows an isolate on its own goroutine.
+func (r *Renderer) Workers() int {
+	if r.workers == nil {
+		return 0
 	}
+	return len(r.workers.workers)
 }
 
 // Render renders the provided path to HTML with optional data payload.
-func (r *Renderer) Render(urlPath string, payload map[string]any) (Result, error) {
-	iso := r.pool.Get()
-	defer r.pool.Put(iso)
+// When ctx is cancelled or its deadline passes, the running script is
+// terminated and the isolate is discarded instead of returned to the pool.
+func (r *Renderer) Render(ctx context.Context, urlPath string, payload map[string]any) (Result, error) {
+	return r.run(ctx, urlPath, payload, nil)
+}
+
+// RenderStream renders like Render but hands HTML to w as server.js produces
+// it, through its ssrRenderStream(url, write) export. Bundles without that
+// export are rendered with ssrRender and written as a single chunk. The
+// returned Result has no HTML; its Head holds only head content set after
+// w.WriteHead was called, and BodyEnd is final. Attributes, status, headers
+// and cookies are handed to w.WriteHead, so server.js must set them before
+// its first chunk.
+func (r *Renderer) RenderStream(ctx context.Context, urlPath string, payload map[string]any, w StreamWriter) (Result, error) {
+	return r.run(ctx, urlPath, payload, w)
+}
+
+func (r *Renderer) run(ctx context.Context, urlPath string, payload map[string]any, stream StreamWriter) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, fmt.Errorf("render aborted: %w", err)
+	}
+	if r.workers != nil {
+		return r.workers.do(ctx, urlPath, payload, stream)
+	}
+
+	iso, err := r.pool.Get(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("acquire isolate: %w", err)
+	}
+
+	var terminated atomic.Bool
+	done := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			terminated.Store(true)
+			iso.Isolate.TerminateExecution()
+		case <-done:
+		}
+	}()
+
+	result, err := r.execute(ctx, iso, urlPath, payload, stream)
+
+	close(done)
+	<-watcherDone
+
+	if terminated.Load() {
+		r.pool.Discard(iso)
+		return Result{}, fmt.Errorf("render aborted: %w", ctx.Err())
+	}
+	if errors.Is(err, ErrHeapLimit) {
+		r.pool.discard(iso, recycleHeapLimit)
+		return Result{}, err
+	}
+	if errors.Is(err, ErrRenderPanic) {
+		r.pool.Discard(iso)
+		return Result{}, err
+	}
+
+	r.pool.Put(iso)
+	return result, r.pool.bundle.mapError(err)
+}
 
-	ctx := v8go.NewContext(iso.Isolate)
-	defer ctx.Close()
+// execute renders on iso, which the caller holds and terminates when ctx is
+// done. A panic fails the render with ErrRenderPanic and leaves iso mid-render,
+// so the caller must not reuse it.
+func (r *Renderer) execute(ctx context.Context, iso *IsolateContainer, urlPath string, payload map[string]any, stream StreamWriter) (result Result, err error) {
+	requestID := RequestIDFromContext(ctx)
+	iso.state = &renderState{
+		ctx:       ctx,
+		path:      urlPath,
+		requestID: requestID,
+		request:   RequestFromContext(ctx),
+		bundle:    r.pool.bundle,
+		console: consoleLog{
+			ctx:       ctx,
+			path:      urlPath,
+			requestID: requestID,
+			bundle:    r.pool.bundle,
+			maxLines:  r.opts.consoleMaxLines,
+		},
+		loop:      newEventLoop(),
+		heapLimit: r.pool.opts.HeapLimit,
+		stream:    stream,
+	}
+	defer func() {
+		iso.state.loop.stop()
+		iso.state = nil
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = Result{}, fmt.Errorf("%w: %v", ErrRenderPanic, p)
+		}
+	}()
+
+	result, err = r.render(ctx, iso, urlPath, payload)
+	if err == nil {
+		err = checkHeap(iso.Isolate, iso.state.heapLimit)
+	}
+	return result, err
+}
+
+func (r *Renderer) render(ctx context.Context, iso *IsolateContainer, urlPath string, payload map[string]any) (Result, error) {
+	v8ctx := v8go.NewContext(iso.Isolate, iso.Global)
+	defer v8ctx.Close()
+
+	if err := bindConsole(v8ctx, iso); err != nil {
+		return Result{}, err
+	}
+	if err := runPreludes(v8ctx, iso); err != nil {
+		return Result{}, err
+	}
 
 	if len(payload) > 0 {
 		jsonData, err := json.Marshal(payload)
@@ -46,45 +303,235 @@ func (r *Renderer) Render(urlPath string, payload map[string]any) (Result, error
 
 		escaped := template.JSEscapeString(string(jsonData))
 		script := fmt.Sprintf(`globalThis.__SSR_DATA__ = JSON.parse("%s");`, escaped)
-		if _, err := ctx.RunScript(script, "ssr-data.js"); err != nil {
+		if _, err := v8ctx.RunScript(script, "ssr-data.js"); err != nil {
+			return Result{}, formatError(err)
+		}
+	}
+
+	requestInfo, err := requestInfoJSON(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if requestInfo != "" {
+		script := fmt.Sprintf(`%s("%s");`, requestInfoPrelude, template.JSEscapeString(requestInfo))
+		if _, err := v8ctx.RunScript(script, "ssr-request.js"); err != nil {
 			return Result{}, formatError(err)
 		}
 	}
 
-	iso.RenderScript.Run(ctx)
+	entryCmd := fmt.Sprintf("require(%s)", strconv.Quote("./"+r.ssrScriptName))
+	if _, err := v8ctx.RunScript(entryCmd, "ssr-entry.js"); err != nil {
+		return Result{}, formatError(err)
+	}
+
+	if iso.state.stream != nil {
+		return r.renderStream(ctx, v8ctx, iso, urlPath)
+	}
+
+	renderedHtml, err := r.callRender(ctx, v8ctx, iso, fmt.Sprintf("ssrRender(%s)", strconv.Quote(urlPath)))
+	if err != nil {
+		return Result{}, err
+	}
 
-	quotedPath := strconv.Quote(urlPath)
-	renderCmd := fmt.Sprintf("ssrRender(%s)", quotedPath)
-	val, err := ctx.RunScript(renderCmd, r.ssrScriptName)
+	head, err := readHead(v8ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{HTML: renderedHtml}
+	head.apply(&result)
+	if err := readResponse(v8ctx, &result); err != nil {
+		return Result{}, err
+	}
+	if result.State, err = readAppState(v8ctx); err != nil {
+		return Result{}, err
+	}
+
+	return result, nil
+}
+
+func (r *Renderer) renderStream(ctx context.Context, v8ctx *v8go.Context, iso *IsolateContainer, urlPath string) (Result, error) {
+	state := iso.state
+
+	hasStream, err := v8ctx.RunScript("typeof ssrRenderStream === 'function'", "ssr-entry.js")
 	if err != nil {
 		return Result{}, formatError(err)
 	}
 
-	renderedHtml := ""
+	if hasStream.Boolean() {
+		if _, err := r.callRender(ctx, v8ctx, iso, fmt.Sprintf("__ssrRenderStream(%s)", strconv.Quote(urlPath))); err != nil {
+			return Result{}, err
+		}
+		if err := state.startStream(v8ctx); err != nil {
+			return Result{}, err
+		}
+	} else {
+		html, err := r.callRender(ctx, v8ctx, iso, fmt.Sprintf("ssrRender(%s)", strconv.Quote(urlPath)))
+		if err != nil {
+			return Result{}, err
+		}
+		if err := state.writeChunk(v8ctx, html); err != nil {
+			return Result{}, err
+		}
+	}
+
+	head, err := readHead(v8ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	appState, err := readAppState(v8ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{Head: lateHead(state.streamedHead, head.Head), BodyEnd: head.BodyEnd, State: appState}, nil
+}
+
+// callRender runs cmd and waits for the promise it returns, if any.
+func (r *Renderer) callRender(ctx context.Context, v8ctx *v8go.Context, iso *IsolateContainer, cmd string) (string, error) {
+	val, err := v8ctx.RunScript(cmd, "ssr-render.js")
+	if err != nil {
+		return "", formatError(err)
+	}
 
 	if val.IsPromise() {
-		result, err := resolvePromise(ctx, val, err)
+		result, err := resolvePromise(ctx, v8ctx, iso.state, val, err)
 		if err != nil {
-			return Result{}, formatError(err)
+			return "", formatError(err)
 		}
+		val = result
+	}
 
-		renderedHtml = result.String()
-	} else {
-		renderedHtml = val.String()
+	if val.IsNullOrUndefined() {
+		return "", nil
+	}
+	return val.String(), nil
+}
+
+// installResponse defines __SSR_RESPONSE__ in every context.
+func installResponse(c *IsolateContainer) error {
+	return c.addPrelude(responsePrelude, "ssr-response.js")
+}
+
+//go:embed fetch.js
+var fetchPrelude string
+
+// installFetch exposes fetch() backed by handler. Requests never leave the
+// process: they are served by handler on the render goroutine.
+func installFetch(c *IsolateContainer, handler http.Handler, opts FetchOptions) error {
+	opts = opts.withDefaults()
+
+	err := c.setHostFunc("fetch", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		var req fetchRequest
+		if err := json.Unmarshal([]byte(stringArg(info, 0)), &req); err != nil {
+			return nil, err
+		}
+
+		res := fetchBudgetError(opts)
+		if c.state.fetches++; c.state.fetches <= opts.MaxRequests {
+			res = serveFetch(c.state.ctx, c.state.request, handler, opts, req)
+		}
+		encoded, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		return v8go.NewValue(c.Isolate, string(encoded))
+	})
+	if err != nil {
+		return err
 	}
 
-	headVal, err := ctx.RunScript("globalThis.__SSR_HEAD__ || ''", "ssr-head.js")
+	return c.addPrelude(fetchPrelude, "ssr-fetch.js")
+}
+
+// installFunctions exposes the functions registered with RegisterFunction
+// and RegisterAsyncFunction as globals.
+func installFunctions(c *IsolateContainer, fns map[string]*hostFunction) error {
+	if len(fns) == 0 {
+		return nil
+	}
+
+	lookup := func(info *v8go.FunctionCallbackInfo, async bool) (*hostFunction, error) {
+		f, ok := fns[stringArg(info, 0)]
+		if !ok || f.async != async {
+			return nil, fmt.Errorf("no Go function %q", stringArg(info, 0))
+		}
+		return f, nil
+	}
+
+	err := c.setHostFunc("callFunction", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		f, err := lookup(info, false)
+		if err != nil {
+			return nil, err
+		}
+		result, err := f.call(c.state.ctx, stringArg(info, 1))
+		if err != nil {
+			return nil, err
+		}
+		return v8go.NewValue(c.Isolate, result)
+	})
 	if err != nil {
-		return Result{}, formatError(err)
+		return err
 	}
 
-	headContent := ""
-	if headVal != nil {
-		headContent = headVal.String()
+	err = c.setHostFunc("callAsyncFunction", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		f, err := lookup(info, true)
+		if err != nil {
+			return nil, err
+		}
+		resolver, err := v8go.NewPromiseResolver(info.Context())
+		if err != nil {
+			return nil, err
+		}
+		ctx, args := c.state.ctx, stringArg(info, 1)
+		c.state.loop.goCall(resolver, func() (string, error) {
+			return f.call(ctx, args)
+		})
+		return resolver.GetPromise().Value, nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return Result{
-		HTML: renderedHtml,
-		Head: headContent,
-	}, nil
+	if err := c.host.Set("functions", functionList(fns)); err != nil {
+		return err
+	}
+	return c.addPrelude(functionPrelude, "ssr-functions.js")
+}
+
+func readHead(ctx *v8go.Context) (headState, error) {
+	val, err := ctx.RunScript(headScript, "ssr-head.js")
+	if err != nil {
+		return headState{}, formatError(err)
+	}
+	if val == nil || !val.IsString() {
+		return headState{}, nil
+	}
+	return parseHead(val.String())
+}
+
+// readResponse copies what server.js set on __SSR_RESPONSE__ into res.
+func readResponse(ctx *v8go.Context, res *Result) error {
+	val, err := ctx.RunScript(responseScript, "ssr-response.js")
+	if err != nil {
+		return formatError(err)
+	}
+	if val == nil || !val.IsString() {
+		return nil
+	}
+	return parseResponse(val.String(), res)
+}
+
+// readAppState returns globalThis.__SSR_STATE__, or nil when server.js did not
+// set an object.
+func readAppState(ctx *v8go.Context) (map[string]any, error) {
+	val, err := ctx.RunScript(appStateScript, "ssr-state.js")
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if val == nil || !val.IsString() {
+		return nil, nil
+	}
+	return parseAppState(val.String())
 }
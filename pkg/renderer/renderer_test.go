@@ -0,0 +1,87 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRenderErrorMapsStack(t *testing.T) {
+	fsys := fstest.MapFS{
+		"server.js": {Data: []byte(`globalThis.ssrRender = () => boom()
+function boom() { throw new Error("kaboom") }`)},
+		// Line 1 maps to src/App.vue:5:3 and line 2 to src/App.vue:10:3.
+		"server.js.map": {Data: []byte(`{"version":3,"sources":["../src/App.vue"],"mappings":"AAIE;AAKA"}`)},
+	}
+	r, err := NewRenderer(fsys, "server.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+
+	_, err = r.Render(context.Background(), "/", nil)
+	if err == nil {
+		t.Fatal("Render succeeded, want the thrown error")
+	}
+	for _, frame := range []string{"at boom (src/App.vue:10:3)", "src/App.vue:5:3"} {
+		if !strings.Contains(err.Error(), frame) {
+			t.Errorf("error does not contain %q:\n%v", frame, err)
+		}
+	}
+}
+
+func TestRenderHeapLimit(t *testing.T) {
+	// The limit is checked when the render returns, so /bloat keeps what it
+	// allocated reachable until then.
+	bundle := serverBundle(`globalThis.ssrRender = (p) => {
+  if (p === "/bloat") { globalThis.big = []; for (let i = 0; i < 1e6; i++) big.push({ n: i }) }
+  return p
+}`)
+	for _, workers := range []int{0, 1} {
+		r, err := NewRenderer(bundle, "server.js", WithWorkers(workers), WithPoolOptions(PoolOptions{MaxIsolates: 1, HeapLimit: 16 << 20}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(r.Close)
+
+		if _, err := r.Render(context.Background(), "/bloat", nil); !errors.Is(err, ErrHeapLimit) {
+			t.Fatalf("workers=%d: render past the limit returned %v, want %v", workers, err, ErrHeapLimit)
+		}
+		if destroyed := r.Stats().Destroyed; destroyed != 1 {
+			t.Fatalf("workers=%d: destroyed %d isolates, want the one over the limit", workers, destroyed)
+		}
+		if res, err := r.Render(context.Background(), "/after", nil); err != nil || res.HTML != "/after" {
+			t.Fatalf("workers=%d: render after the limit = %q, %v", workers, res.HTML, err)
+		}
+	}
+}
+
+func TestRenderFetchBudget(t *testing.T) {
+	bundle := serverBundle(`globalThis.ssrRender = async () => {
+  const out = []
+  for (let i = 0; i < 3; i++) {
+    try { out.push((await fetch("/api/n")).status) }
+    catch (err) { out.push(err.message) }
+  }
+  return out.join("|")
+}`)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r, err := NewRenderer(bundle, "server.js", WithFetch(handler, FetchOptions{MaxRequests: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+
+	res, err := r.Render(context.Background(), "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "200|200|fetch budget of 2 requests per render exceeded"; res.HTML != want {
+		t.Fatalf("fetches = %q, want %q", res.HTML, want)
+	}
+}
@@ -0,0 +1,98 @@
+package renderer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RequestInfo describes the incoming request to server.js as the read-only
+// globalThis.__SSR_REQUEST__. Only allowlisted headers and cookies are
+// copied, so secrets such as session cookies never reach the JS heap.
+type RequestInfo struct {
+	Method string `json:"method"`
+	// URL is the path and query string as requested.
+	URL   string              `json:"url"`
+	Path  string              `json:"path"`
+	Query map[string][]string `json:"query"`
+	Host  string              `json:"host"`
+	// IP is the client address.
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	// Headers maps lowercase header names to their values joined by ", ".
+	Headers map[string]string `json:"headers"`
+	Cookies map[string]string `json:"cookies"`
+}
+
+// RequestInfoOptions selects what NewRequestInfo copies from a request.
+type RequestInfoOptions struct {
+	// Headers lists the header names to copy; matching ignores case. The
+	// Cookie header is never copied, cookies are listed in Cookies instead.
+	Headers []string
+	// Cookies lists the cookie names to copy.
+	Cookies []string
+}
+
+// NewRequestInfo describes r with the headers and cookies opts allows. IP
+// is the peer address; callers behind a proxy should replace it.
+func NewRequestInfo(r *http.Request, opts RequestInfoOptions) RequestInfo {
+	info := RequestInfo{
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Path:      r.URL.Path,
+		Query:     r.URL.Query(),
+		Host:      r.Host,
+		IP:        r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Headers:   map[string]string{},
+		Cookies:   map[string]string{},
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.IP = host
+	}
+
+	for _, name := range opts.Headers {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "cookie" {
+			continue
+		}
+		if values := r.Header.Values(name); len(values) > 0 {
+			info.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	for _, name := range opts.Cookies {
+		if cookie, err := r.Cookie(strings.TrimSpace(name)); err == nil {
+			info.Cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return info
+}
+
+// requestInfoPrelude defines __SSR_REQUEST__ from its JSON, frozen all the
+// way down and neither writable nor configurable.
+const requestInfoPrelude = `(raw => {
+  const freeze = (v) => {
+    if (v && typeof v === 'object') {
+      Object.values(v).forEach(freeze)
+      Object.freeze(v)
+    }
+    return v
+  }
+  Object.defineProperty(globalThis, '__SSR_REQUEST__', { value: freeze(JSON.parse(raw)), enumerable: true })
+})`
+
+// requestInfoJSON returns the RequestInfo set by WithRequestInfo as JSON,
+// or "" when there is none.
+func requestInfoJSON(ctx context.Context) (string, error) {
+	info, ok := RequestInfoFromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,40 @@
+//go:build cgo
+
+package renderer
+
+import (
+	_ "embed"
+
+	"rogchap.com/v8go"
+)
+
+//go:embed require.js
+var requirePrelude string
+
+// installRequire exposes a CommonJS require() that loads modules from the
+// server dist filesystem.
+func installRequire(c *IsolateContainer) error {
+	err := c.setHostFunc("resolveModule", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		resolved, err := c.pool.bundle.resolve(stringArg(info, 0), stringArg(info, 1))
+		if err != nil {
+			return nil, err
+		}
+		return v8go.NewValue(c.Isolate, resolved)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.setHostFunc("loadModule", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		script, err := c.module(stringArg(info, 0))
+		if err != nil {
+			return nil, err
+		}
+		return script.Run(info.Context())
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.addPrelude(requirePrelude, "ssr-require.js")
+}
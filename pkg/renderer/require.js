@@ -0,0 +1,51 @@
+// CommonJS loader for the multi-file server bundle. Module functions are
+// compiled once per isolate in Go; instances are cached per context.
+(function (host) {
+  'use strict'
+
+  const cache = Object.create(null)
+
+  function dirname(filename) {
+    const i = filename.lastIndexOf('/')
+    return i === -1 ? '' : filename.slice(0, i)
+  }
+
+  function load(filename) {
+    const cached = cache[filename]
+    if (cached)
+      return cached.exports
+
+    const module = { id: filename, filename, exports: {}, loaded: false }
+    cache[filename] = module
+
+    const wrapper = host.loadModule(filename)
+    try {
+      wrapper.call(module.exports, module.exports, makeRequire(dirname(filename)), module, filename, dirname(filename))
+    }
+    catch (err) {
+      delete cache[filename]
+      throw err
+    }
+    module.loaded = true
+    return module.exports
+  }
+
+  function makeRequire(dir) {
+    const require = spec => load(require.resolve(spec))
+    require.resolve = (spec) => {
+      const resolved = host.resolveModule(dir, String(spec))
+      if (typeof resolved !== 'string')
+        throw new Error(`Cannot find module '${spec}'`)
+      return resolved
+    }
+    require.cache = cache
+    return require
+  }
+
+  Object.defineProperty(globalThis, 'require', {
+    value: makeRequire(''),
+    writable: true,
+    configurable: true,
+    enumerable: false,
+  })
+})
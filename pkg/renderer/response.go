@@ -0,0 +1,77 @@
+package renderer
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//go:embed response.js
+var responsePrelude string
+
+type responseState struct {
+	Status   int         `json:"status"`
+	Location string      `json:"location"`
+	Headers  [][2]string `json:"headers"`
+	Cookies  []string    `json:"cookies"`
+}
+
+// responseScript serializes the data fields of __SSR_RESPONSE__.
+const responseScript = "JSON.stringify(globalThis.__SSR_RESPONSE__ || null)"
+
+// parseResponse copies the output of responseScript into res. Invalid
+// statuses and header names are rejected so a bad value fails the render
+// instead of the response write.
+func parseResponse(raw string, res *Result) error {
+	var state *responseState
+	if err := json.Unmarshal([]byte(raw), &state); err != nil {
+		return fmt.Errorf("invalid __SSR_RESPONSE__: %w", err)
+	}
+	if state == nil {
+		return nil
+	}
+
+	if state.Status != 0 && (state.Status < 200 || state.Status > 599) {
+		return fmt.Errorf("invalid __SSR_RESPONSE__ status %d", state.Status)
+	}
+	if state.Location != "" {
+		if state.Status == 0 {
+			state.Status = http.StatusFound
+		}
+		if state.Status < 300 || state.Status > 399 {
+			return fmt.Errorf("invalid __SSR_RESPONSE__ redirect status %d", state.Status)
+		}
+	}
+
+	res.Status = state.Status
+	res.Location = state.Location
+	res.Cookies = state.Cookies
+
+	for _, h := range state.Headers {
+		if !validHeaderName(h[0]) {
+			return fmt.Errorf("invalid __SSR_RESPONSE__ header name %q", h[0])
+		}
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		res.Header.Add(h[0], h[1])
+	}
+
+	return nil
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return false
+		default:
+			return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+		}
+	}) == -1
+}
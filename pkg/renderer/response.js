@@ -0,0 +1,43 @@
+// __SSR_RESPONSE__ lets server.js shape the HTTP response of the render:
+// status code, redirect, extra headers and Set-Cookie entries. Go reads the
+// data fields back as JSON once rendering finishes.
+(function () {
+  'use strict'
+
+  const response = {
+    status: 0,
+    location: '',
+    headers: [],
+    cookies: [],
+  }
+
+  function method(name, fn) {
+    Object.defineProperty(response, name, { value: fn, enumerable: false })
+  }
+
+  method('setStatus', (code) => {
+    response.status = Number(code) | 0
+  })
+  method('redirect', (location, status = 302) => {
+    response.location = String(location)
+    response.status = Number(status) | 0
+  })
+  method('setHeader', (name, value) => {
+    const key = String(name).toLowerCase()
+    response.headers = response.headers.filter(([n]) => n.toLowerCase() !== key)
+    response.headers.push([String(name), String(value)])
+  })
+  method('appendHeader', (name, value) => {
+    response.headers.push([String(name), String(value)])
+  })
+  method('setCookie', (cookie) => {
+    response.cookies.push(String(cookie))
+  })
+
+  Object.defineProperty(globalThis, '__SSR_RESPONSE__', {
+    value: response,
+    writable: true,
+    configurable: true,
+    enumerable: false,
+  })
+})
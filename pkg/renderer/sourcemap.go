@@ -0,0 +1,205 @@
+package renderer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceMap is a decoded source map (revision 3) of one bundle module.
+type sourceMap struct {
+	sources []string
+	// lines holds the segments of each generated line, by column.
+	lines [][]mapping
+}
+
+type mapping struct {
+	genCol  int
+	source  int
+	srcLine int
+	srcCol  int
+}
+
+type rawSourceMap struct {
+	Version    int      `json:"version"`
+	SourceRoot string   `json:"sourceRoot"`
+	Sources    []string `json:"sources"`
+	Mappings   string   `json:"mappings"`
+}
+
+// parseSourceMap decodes data, the map of the module at name. Source paths
+// are resolved against the module's directory with leading ../ dropped, so
+// ../../src/App.vue reads src/App.vue.
+func parseSourceMap(name string, data []byte) (*sourceMap, error) {
+	var raw rawSourceMap
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Version != 3 {
+		return nil, fmt.Errorf("unsupported source map version %d", raw.Version)
+	}
+
+	m := &sourceMap{sources: make([]string, len(raw.Sources))}
+	for i, src := range raw.Sources {
+		p := path.Join(path.Dir(name), raw.SourceRoot, src)
+		for strings.HasPrefix(p, "../") {
+			p = p[3:]
+		}
+		m.sources[i] = p
+	}
+
+	// Source index, line and column are deltas across the whole mappings
+	// string; the generated column restarts on every line.
+	var source, srcLine, srcCol int
+	for _, line := range strings.Split(raw.Mappings, ";") {
+		var segments []mapping
+		genCol := 0
+		for _, seg := range strings.Split(line, ",") {
+			if seg == "" {
+				continue
+			}
+			fields, err := decodeVLQ(seg)
+			if err != nil {
+				return nil, err
+			}
+			genCol += fields[0]
+			if len(fields) < 4 {
+				continue
+			}
+			source += fields[1]
+			srcLine += fields[2]
+			srcCol += fields[3]
+			if source >= 0 && source < len(m.sources) {
+				segments = append(segments, mapping{genCol: genCol, source: source, srcLine: srcLine, srcCol: srcCol})
+			}
+		}
+		sort.SliceStable(segments, func(i, j int) bool { return segments[i].genCol < segments[j].genCol })
+		m.lines = append(m.lines, segments)
+	}
+
+	return m, nil
+}
+
+// lookup maps a zero-based generated position to its zero-based source
+// position, using the closest segment at or before col.
+func (m *sourceMap) lookup(line, col int) (source string, srcLine, srcCol int, ok bool) {
+	if line < 0 || line >= len(m.lines) {
+		return "", 0, 0, false
+	}
+	segments := m.lines[line]
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].genCol > col }) - 1
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	seg := segments[i]
+	return m.sources[seg.source], seg.srcLine, seg.srcCol, true
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+var errInvalidVLQ = errors.New("invalid source map mappings")
+
+func decodeVLQ(seg string) ([]int, error) {
+	var fields []int
+	value, shift := 0, 0
+	for i := 0; i < len(seg); i++ {
+		digit := strings.IndexByte(base64Digits, seg[i])
+		if digit < 0 {
+			return nil, errInvalidVLQ
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 != 0 {
+			fields = append(fields, -(value >> 1))
+		} else {
+			fields = append(fields, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 || len(fields) == 0 {
+		return nil, errInvalidVLQ
+	}
+	return fields, nil
+}
+
+// stackLocation matches file:line:column in a V8 stack frame.
+var stackLocation = regexp.MustCompile(`([^\s()]+):(\d+):(\d+)`)
+
+// sourceMap returns the map of module name, read from name.map on first use,
+// or nil when the bundle has none.
+func (b *bundle) sourceMap(name string) *sourceMap {
+	b.mu.RLock()
+	m, ok := b.maps[name]
+	b.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	if data, err := fs.ReadFile(b.fsys, name+".map"); err == nil {
+		m, _ = parseSourceMap(name, data)
+	}
+
+	b.mu.Lock()
+	b.maps[name] = m
+	b.mu.Unlock()
+	return m
+}
+
+// mapStack rewrites bundle positions in a stack trace to the original
+// sources. Module code starts one line after the CommonJS wrapper, so line 2
+// of the compiled script is line 1 of the file. Positions without a mapping
+// are left as they are.
+func (b *bundle) mapStack(stack string) string {
+	return stackLocation.ReplaceAllStringFunc(stack, func(loc string) string {
+		parts := stackLocation.FindStringSubmatch(loc)
+		name := parts[1]
+		b.mu.RLock()
+		_, loaded := b.sources[name]
+		b.mu.RUnlock()
+		if !loaded {
+			return loc
+		}
+		m := b.sourceMap(name)
+		if m == nil {
+			return loc
+		}
+
+		line, _ := strconv.Atoi(parts[2])
+		col, _ := strconv.Atoi(parts[3])
+		source, srcLine, srcCol, ok := m.lookup(line-2, col-1)
+		if !ok {
+			return loc
+		}
+		return fmt.Sprintf("%s:%d:%d", source, srcLine+1, srcCol+1)
+	})
+}
+
+// mapError rewrites the stack trace in err, keeping errors it wraps.
+func (b *bundle) mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	mapped := b.mapStack(msg)
+	if mapped == msg {
+		return err
+	}
+	return &mappedError{msg: mapped, err: err}
+}
+
+type mappedError struct {
+	msg string
+	err error
+}
+
+func (e *mappedError) Error() string { return e.msg }
+func (e *mappedError) Unwrap() error { return e.err }
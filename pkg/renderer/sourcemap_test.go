@@ -0,0 +1,128 @@
+package renderer
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDecodeVLQ(t *testing.T) {
+	tests := []struct {
+		seg  string
+		want []int
+	}{
+		{"A", []int{0}},
+		{"C", []int{1}},
+		{"D", []int{-1}},
+		{"gB", []int{16}},
+		{"hB", []int{-16}},
+		{"2H", []int{123}},
+		{"AAgBC", []int{0, 0, 16, 1}},
+	}
+	for _, tt := range tests {
+		got, err := decodeVLQ(tt.seg)
+		if err != nil {
+			t.Errorf("decodeVLQ(%q): %v", tt.seg, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("decodeVLQ(%q) = %v, want %v", tt.seg, got, tt.want)
+		}
+	}
+
+	for _, seg := range []string{"", "g", "A!", "AAg"} {
+		if got, err := decodeVLQ(seg); err == nil {
+			t.Errorf("decodeVLQ(%q) = %v, want an error", seg, got)
+		}
+	}
+}
+
+// testMap maps two generated lines of assets/app.js; source, line and
+// column deltas carry over from one generated line to the next:
+//
+//	line 0, column 0 -> line 9, column 4 (in src/app.ts)
+//	line 0, column 6 -> line 10, column 0
+//	line 1, column 2 -> line 30, column 0 (in src/util.ts)
+const testMap = `{
+	"version": 3,
+	"sources": ["../src/app.ts", "../src/util.ts"],
+	"mappings": "AASI,MACJ;ECoBA"
+}`
+
+func TestSourceMapLookup(t *testing.T) {
+	m, err := parseSourceMap("assets/app.js", []byte(testMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line, col int
+		source    string
+		srcLine   int
+		srcCol    int
+		ok        bool
+	}{
+		{0, 0, "src/app.ts", 9, 4, true},
+		{0, 5, "src/app.ts", 9, 4, true},
+		{0, 6, "src/app.ts", 10, 0, true},
+		{0, 99, "src/app.ts", 10, 0, true},
+		{1, 1, "", 0, 0, false},
+		{1, 2, "src/util.ts", 30, 0, true},
+		{2, 0, "", 0, 0, false},
+		{-1, 0, "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		source, srcLine, srcCol, ok := m.lookup(tt.line, tt.col)
+		if source != tt.source || srcLine != tt.srcLine || srcCol != tt.srcCol || ok != tt.ok {
+			t.Errorf("lookup(%d, %d) = %q %d %d %v, want %q %d %d %v",
+				tt.line, tt.col, source, srcLine, srcCol, ok, tt.source, tt.srcLine, tt.srcCol, tt.ok)
+		}
+	}
+}
+
+func TestParseSourceMapErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"version": 2, "sources": [], "mappings": ""}`,
+		`{"version": 3, "sources": ["a.ts"], "mappings": "A!"}`,
+		`not json`,
+	} {
+		if _, err := parseSourceMap("a.js", []byte(data)); err == nil {
+			t.Errorf("parseSourceMap(%s) succeeded", data)
+		}
+	}
+}
+
+func TestMapStack(t *testing.T) {
+	b, err := loadBundle(fstest.MapFS{
+		"server.js":         {Data: []byte("require('./assets/app.js')")},
+		"assets/app.js":     {Data: []byte("throw new Error('x')\n")},
+		"assets/app.js.map": {Data: []byte(testMap)},
+		"assets/other.js":   {Data: []byte("")},
+	}, "server.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"assets/app.js", "assets/other.js"} {
+		if _, err := b.source(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Line 1 of the compiled script is the CommonJS wrapper, so line 2
+	// column 7 is generated line 0 column 6.
+	stack := "Error: x\n" +
+		"    at render (assets/app.js:2:7)\n" +
+		"    at assets/app.js:3:3\n" +
+		"    at assets/app.js:9:1\n" +
+		"    at assets/other.js:2:1\n" +
+		"    at unloaded.js:2:1"
+	want := "Error: x\n" +
+		"    at render (src/app.ts:11:1)\n" +
+		"    at src/util.ts:31:1\n" +
+		"    at assets/app.js:9:1\n" +
+		"    at assets/other.js:2:1\n" +
+		"    at unloaded.js:2:1"
+	if got := b.mapStack(stack); got != want {
+		t.Errorf("mapStack:\n got %s\nwant %s", got, want)
+	}
+}
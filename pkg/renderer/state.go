@@ -0,0 +1,31 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"context"
+	"net/http"
+)
+
+// renderState carries per-render data to host callbacks installed on the
+// isolate's global template.
+type renderState struct {
+	ctx       context.Context
+	path      string
+	requestID string
+	request   *http.Request
+	// bundle maps stack traces in errors.
+	bundle *bundle
+
+	console consoleLog
+
+	loop *eventLoop
+	// heapLimit is PoolOptions.HeapLimit.
+	heapLimit uint64
+
+	fetches int
+
+	stream        StreamWriter
+	streamStarted bool
+	streamedHead  string
+}
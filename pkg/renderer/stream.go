@@ -0,0 +1,61 @@
+//go:build cgo
+
+package renderer
+
+import (
+	_ "embed"
+	"errors"
+
+	"rogchap.com/v8go"
+)
+
+//go:embed stream.js
+var streamPrelude string
+
+// installStream exposes the host side of the chunk callback handed to
+// ssrRenderStream.
+func installStream(c *IsolateContainer) error {
+	err := c.setHostFunc("write", func(c *IsolateContainer, info *v8go.FunctionCallbackInfo) (*v8go.Value, error) {
+		if c.state.stream == nil {
+			return nil, errors.New("render is not streaming")
+		}
+		return nil, c.state.writeChunk(info.Context(), stringArg(info, 0))
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.addPrelude(streamPrelude, "ssr-stream.js")
+}
+
+// writeChunk flushes the head before the first chunk so it still carries what
+// server.js set before rendering started.
+func (s *renderState) writeChunk(ctx *v8go.Context, chunk string) error {
+	if err := s.startStream(ctx); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+	return s.stream.WriteChunk(chunk)
+}
+
+func (s *renderState) startStream(ctx *v8go.Context) error {
+	if s.streamStarted {
+		return nil
+	}
+	s.streamStarted = true
+
+	head, err := readHead(ctx)
+	if err != nil {
+		return err
+	}
+	var res Result
+	head.apply(&res)
+	if err := readResponse(ctx, &res); err != nil {
+		return err
+	}
+
+	s.streamedHead = head.Head
+	return s.stream.WriteHead(res)
+}
@@ -0,0 +1,14 @@
+// Entry point for streaming renders. server.js exports
+// ssrRenderStream(url, write); write forwards chunks to Go as they arrive.
+(function (host) {
+  'use strict'
+
+  const write = chunk => host.write(chunk === undefined || chunk === null ? '' : String(chunk))
+
+  Object.defineProperty(globalThis, '__ssrRenderStream', {
+    value: url => globalThis.ssrRenderStream(url, write),
+    writable: false,
+    configurable: true,
+    enumerable: false,
+  })
+})
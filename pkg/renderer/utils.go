@@ -1,23 +1,44 @@
+//go:build cgo
+
 package renderer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"rogchap.com/v8go"
 )
 
-func resolvePromise(ctx *v8go.Context, val *v8go.Value, err error) (*v8go.Value, error) {
+// resolvePromise runs microtasks and due timers until the promise settles.
+func resolvePromise(goCtx context.Context, ctx *v8go.Context, state *renderState, val *v8go.Value, err error) (*v8go.Value, error) {
 	if err != nil || !val.IsPromise() {
 		return val, err
 	}
 	for {
+		if err := goCtx.Err(); err != nil {
+			return nil, err
+		}
 		switch p, _ := val.AsPromise(); p.State() {
 		case v8go.Fulfilled:
 			return p.Result(), nil
 		case v8go.Rejected:
-			return nil, errors.New(p.Result().DetailString())
+			return nil, errors.New(errorStack(p.Result()))
 		case v8go.Pending:
 			ctx.PerformMicrotaskCheckpoint() // run VM to make progress on the promise
+			if p.State() != v8go.Pending {
+				continue
+			}
+			if err := checkHeap(ctx.Isolate(), state.heapLimit); err != nil {
+				return nil, err
+			}
+
+			ran, err := state.loop.runNext(goCtx, ctx, state)
+			if err != nil {
+				return nil, err
+			}
+			if !ran {
+				return nil, errors.New("promise is still pending but no timers or calls are scheduled")
+			}
 			// go round the loop again...
 		default:
 			return nil, fmt.Errorf("illegal v8go.Promise state %d", p) // unreachable
@@ -33,3 +54,15 @@ func formatError(err error) error {
 
 	return err
 }
+
+// errorStack returns the stack of a thrown value when it has one, so
+// rejected promises report where they failed, or else its string form.
+func errorStack(v *v8go.Value) string {
+	if v.IsObject() {
+		obj, _ := v.AsObject()
+		if stack, err := obj.Get("stack"); err == nil && stack.IsString() {
+			return stack.String()
+		}
+	}
+	return v.DetailString()
+}
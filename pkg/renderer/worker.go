@@ -0,0 +1,362 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WorkerStats describes one render worker; see WithWorkers.
+type WorkerStats struct {
+	ID int `json:"id"`
+	// Busy reports whether the worker is rendering right now.
+	Busy        bool    `json:"busy"`
+	Renders     uint64  `json:"renders"`
+	BusySeconds float64 `json:"busySeconds"`
+}
+
+// renderWorkers is a fixed set of workers taking renders from one queue.
+type renderWorkers struct {
+	queue   renderQueue
+	workers []*renderWorker
+	wg      sync.WaitGroup
+}
+
+func startWorkers(r *Renderer, n int) *renderWorkers {
+	ws := &renderWorkers{}
+	ws.queue.cond.L = &ws.queue.mu
+	for id := range n {
+		w := &renderWorker{
+			id:      id,
+			label:   strconv.Itoa(id),
+			r:       r,
+			queue:   &ws.queue,
+			watch:   make(chan *renderJob),
+			watched: make(chan struct{}),
+		}
+		ws.workers = append(ws.workers, w)
+		ws.wg.Add(1)
+		go func() {
+			defer ws.wg.Done()
+			w.loop()
+		}()
+	}
+	return ws
+}
+
+// do queues a render and waits for it. A render whose context ends or whose
+// queue budget runs out while it is queued leaves the queue; a running one
+// is terminated by its worker when its context ends.
+func (ws *renderWorkers) do(ctx context.Context, urlPath string, payload map[string]any, stream StreamWriter) (Result, error) {
+	job := &renderJob{
+		ctx:      ctx,
+		urlPath:  urlPath,
+		payload:  payload,
+		stream:   stream,
+		priority: PriorityFromContext(ctx),
+		queued:   time.Now(),
+		executed: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	job.deadline, _ = ctx.Deadline()
+	if !ws.queue.push(job) {
+		return Result{}, fmt.Errorf("acquire isolate: %w", ErrPoolClosed)
+	}
+
+	var overBudget <-chan time.Time
+	if budget := QueueBudgetFromContext(ctx); budget > 0 {
+		t := time.NewTimer(budget)
+		defer t.Stop()
+		overBudget = t.C
+	}
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		if ws.queue.remove(job) {
+			return Result{}, fmt.Errorf("%w: %w", ErrQueueWait, ctx.Err())
+		}
+		<-job.done
+	case <-overBudget:
+		if ws.queue.remove(job) {
+			return Result{}, ErrQueueBudget
+		}
+		<-job.done
+	}
+	return job.result, job.err
+}
+
+// close fails the queued renders and waits for the workers to finish the
+// running ones and return their isolates.
+func (ws *renderWorkers) close() {
+	ws.queue.close()
+	ws.wg.Wait()
+}
+
+func (ws *renderWorkers) stats(stats *PoolStats) {
+	stats.Queued = ws.queue.len()
+	stats.Workers = make([]WorkerStats, 0, len(ws.workers))
+	for _, w := range ws.workers {
+		stats.Workers = append(stats.Workers, WorkerStats{
+			ID:          w.id,
+			Busy:        w.busy.Load(),
+			Renders:     w.renders.Load(),
+			BusySeconds: time.Duration(w.busyNanos.Load()).Seconds(),
+		})
+	}
+}
+
+// renderWorker renders on one OS thread with one isolate, which it keeps
+// until the isolate is recycled or terminated.
+type renderWorker struct {
+	id    int
+	label string
+	r     *Renderer
+	queue *renderQueue
+	iso   *IsolateContainer
+
+	// watch hands each render to the goroutine that terminates it when its
+	// context ends, which answers on watched once the render is over.
+	watch   chan *renderJob
+	watched chan struct{}
+
+	busy      atomic.Bool
+	renders   atomic.Uint64
+	busyNanos atomic.Int64
+}
+
+func (w *renderWorker) loop() {
+	// The thread is not unlocked, so it exits with the worker rather than
+	// being handed to other goroutines.
+	runtime.LockOSThread()
+
+	go w.watchRenders()
+	defer close(w.watch)
+
+	// Take an isolate up front so the first render does not pay for it.
+	if iso, err := w.r.pool.Get(context.Background()); err == nil {
+		w.iso = iso
+	}
+
+	for {
+		job := w.queue.pop()
+		if job == nil {
+			break
+		}
+		workerQueueWait.WithLabelValues(job.priority.String()).Observe(time.Since(job.queued).Seconds())
+		job.result, job.err = w.run(job)
+		close(job.done)
+	}
+
+	if w.iso != nil {
+		w.r.pool.release(w.iso)
+		w.iso = nil
+	}
+}
+
+func (w *renderWorker) run(job *renderJob) (result Result, err error) {
+	if err := job.ctx.Err(); err != nil {
+		return Result{}, fmt.Errorf("render aborted: %w", err)
+	}
+	if w.iso == nil {
+		iso, err := w.r.pool.Get(job.ctx)
+		if err != nil {
+			return Result{}, fmt.Errorf("acquire isolate: %w", err)
+		}
+		w.iso = iso
+	}
+
+	start := time.Now()
+	w.busy.Store(true)
+	defer func() {
+		elapsed := time.Since(start)
+		w.busy.Store(false)
+		w.renders.Add(1)
+		w.busyNanos.Add(int64(elapsed))
+		workerRenders.WithLabelValues(w.label).Inc()
+		workerBusy.WithLabelValues(w.label).Add(elapsed.Seconds())
+	}()
+
+	job.iso = w.iso
+	w.watch <- job
+	result, err = w.r.execute(job.ctx, w.iso, job.urlPath, job.payload, job.stream)
+	close(job.executed)
+	<-w.watched
+
+	switch {
+	case job.terminated.Load():
+		w.r.pool.Discard(w.iso)
+		w.iso = nil
+		return Result{}, fmt.Errorf("render aborted: %w", job.ctx.Err())
+	case errors.Is(err, ErrHeapLimit):
+		w.r.pool.discard(w.iso, recycleHeapLimit)
+		w.iso = nil
+		return Result{}, err
+	case errors.Is(err, ErrRenderPanic):
+		w.r.pool.Discard(w.iso)
+		w.iso = nil
+		return Result{}, err
+	}
+
+	if !w.r.pool.renew(w.iso) {
+		w.iso = nil
+	}
+	return result, w.r.pool.bundle.mapError(err)
+}
+
+// watchRenders terminates the running render when its context ends, so a
+// worker needs no goroutine per render.
+func (w *renderWorker) watchRenders() {
+	for job := range w.watch {
+		select {
+		case <-job.ctx.Done():
+			job.terminated.Store(true)
+			job.iso.Isolate.TerminateExecution()
+		case <-job.executed:
+		}
+		w.watched <- struct{}{}
+	}
+}
+
+type renderJob struct {
+	ctx      context.Context
+	urlPath  string
+	payload  map[string]any
+	stream   StreamWriter
+	priority Priority
+	// deadline is zero when ctx has none.
+	deadline time.Time
+	queued   time.Time
+	seq      uint64
+	// index is the job's position in the queue, or -1 once it left it.
+	index int
+
+	iso        *IsolateContainer
+	terminated atomic.Bool
+	executed   chan struct{}
+
+	result Result
+	err    error
+	done   chan struct{}
+}
+
+// renderQueue hands renders to workers by priority, then deadline, then
+// arrival.
+type renderQueue struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	jobs   jobHeap
+	seq    uint64
+	closed bool
+}
+
+func (q *renderQueue) push(job *renderJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.seq++
+	job.seq = q.seq
+	heap.Push(&q.jobs, job)
+	q.cond.Signal()
+	return true
+}
+
+// pop waits for the next job, or returns nil once the queue is closed.
+func (q *renderQueue) pop() *renderJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	return heap.Pop(&q.jobs).(*renderJob)
+}
+
+// remove takes job out of the queue and reports whether it was still there.
+func (q *renderQueue) remove(job *renderJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.index < 0 {
+		return false
+	}
+	heap.Remove(&q.jobs, job.index)
+	return true
+}
+
+func (q *renderQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// close fails every queued job with ErrPoolClosed and stops the workers.
+func (q *renderQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	jobs := q.jobs
+	q.jobs = nil
+	for _, job := range jobs {
+		job.index = -1
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	for _, job := range jobs {
+		job.err = fmt.Errorf("acquire isolate: %w", ErrPoolClosed)
+		close(job.done)
+	}
+}
+
+type jobHeap []*renderJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if !a.deadline.Equal(b.deadline) {
+		switch {
+		case a.deadline.IsZero():
+			return false
+		case b.deadline.IsZero():
+			return true
+		}
+		return a.deadline.Before(b.deadline)
+	}
+	return a.seq < b.seq
+}
+
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x any) {
+	job := x.(*renderJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*h = old[:len(old)-1]
+	return job
+}
@@ -0,0 +1,202 @@
+//go:build cgo
+
+package renderer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobHeapOrder(t *testing.T) {
+	now := time.Now()
+	jobs := []*renderJob{
+		{seq: 1, priority: PriorityNormal},
+		{seq: 2, priority: PriorityLow, deadline: now},
+		{seq: 3, priority: PriorityNormal, deadline: now.Add(2 * time.Second)},
+		{seq: 4, priority: PriorityHigh},
+		{seq: 5, priority: PriorityNormal, deadline: now.Add(time.Second)},
+		{seq: 6, priority: PriorityNormal},
+		{seq: 7, priority: PriorityHigh, deadline: now.Add(time.Hour)},
+	}
+	var h jobHeap
+	for _, job := range jobs {
+		heap.Push(&h, job)
+	}
+
+	var got []uint64
+	for h.Len() > 0 {
+		got = append(got, heap.Pop(&h).(*renderJob).seq)
+	}
+	// High priority first, then the earliest deadline, then renders without
+	// one in arrival order.
+	if want := []uint64{7, 4, 5, 3, 1, 6, 2}; !slices.Equal(got, want) {
+		t.Fatalf("pop order %v, want %v", got, want)
+	}
+}
+
+// workerBundle renders its path, busy-waiting first for as many
+// milliseconds as ?ms= asks for, or forever for /loop.
+const workerBundle = `globalThis.ssrRender = (p) => {
+  if (p === "/loop") { for (;;) {} }
+  const ms = Number(new URL(p, "http://x").searchParams.get("ms") || 0)
+  const end = Date.now() + ms
+  while (Date.now() < end) {}
+  return p
+}`
+
+func newTestWorkers(t *testing.T, n int) *Renderer {
+	t.Helper()
+	r, err := NewRenderer(serverBundle(workerBundle), "server.js", WithWorkers(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// occupy keeps the only worker of r busy for d, and waits until it is.
+func occupy(t *testing.T, r *Renderer, d time.Duration) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Render(context.Background(), "/busy?ms="+strconv.FormatInt(d.Milliseconds(), 10), nil)
+		done <- err
+	}()
+	waitFor(t, func() bool { return r.Stats().Workers[0].Busy })
+	return done
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkersRunByPriority(t *testing.T) {
+	r := newTestWorkers(t, 1)
+	busy := occupy(t, r, 300*time.Millisecond)
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	queue := func(path string, p Priority) {
+		queued := r.Stats().Queued
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := r.Render(WithPriority(context.Background(), p), path, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, res.HTML)
+			mu.Unlock()
+		}()
+		waitFor(t, func() bool { return r.Stats().Queued == queued+1 })
+	}
+	// Each queued render takes a while, so its goroutine records it before
+	// the next one finishes.
+	queue("/low?ms=50", PriorityLow)
+	queue("/normal?ms=50", PriorityNormal)
+	queue("/high?ms=50", PriorityHigh)
+
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if want := []string{"/high?ms=50", "/normal?ms=50", "/low?ms=50"}; !slices.Equal(order, want) {
+		t.Fatalf("render order %v, want %v", order, want)
+	}
+}
+
+func TestWorkersTerminateRender(t *testing.T) {
+	r := newTestWorkers(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Render(ctx, "/loop", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("endless render returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if destroyed := r.Stats().Destroyed; destroyed != 1 {
+		t.Fatalf("destroyed %d isolates, want the terminated one", destroyed)
+	}
+
+	res, err := r.Render(context.Background(), "/after", nil)
+	if err != nil || res.HTML != "/after" {
+		t.Fatalf("render after termination = %q, %v", res.HTML, err)
+	}
+}
+
+func TestWorkersQueueBudget(t *testing.T) {
+	r := newTestWorkers(t, 1)
+	busy := occupy(t, r, 200*time.Millisecond)
+
+	ctx := WithQueueBudget(context.Background(), 20*time.Millisecond)
+	if _, err := r.Render(ctx, "/queued", nil); !errors.Is(err, ErrQueueBudget) {
+		t.Fatalf("render queued past its budget returned %v, want %v", err, ErrQueueBudget)
+	}
+	if queued := r.Stats().Queued; queued != 0 {
+		t.Fatalf("%d renders still queued, want the over-budget one removed", queued)
+	}
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkersQueueWait(t *testing.T) {
+	r := newTestWorkers(t, 1)
+	busy := occupy(t, r, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := r.Render(ctx, "/queued", nil)
+	if !errors.Is(err, ErrQueueWait) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("render timing out in the queue returned %v, want %v", err, ErrQueueWait)
+	}
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkersClose(t *testing.T) {
+	r, err := NewRenderer(serverBundle(workerBundle), "server.js", WithWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy := occupy(t, r, 100*time.Millisecond)
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := r.Render(context.Background(), "/queued", nil)
+		queued <- err
+	}()
+	waitFor(t, func() bool { return r.Stats().Queued == 1 })
+
+	r.Close()
+	if err := <-queued; !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("queued render returned %v on Close, want %v", err, ErrPoolClosed)
+	}
+	if err := <-busy; err != nil {
+		t.Fatalf("running render failed on Close: %v", err)
+	}
+	if _, err := r.Render(context.Background(), "/", nil); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Render after Close returned %v, want %v", err, ErrPoolClosed)
+	}
+	if stats := r.Stats(); stats.Busy != 0 || stats.Idle != 0 || stats.Destroyed != stats.Created {
+		t.Fatalf("isolates left after Close: %+v", stats)
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"os"
+	"strings"
+
+	"vitego/pkg/renderer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRequestHeaders are the headers server.js sees in __SSR_REQUEST__
+// unless SSR_REQUEST_HEADERS says otherwise: the language and the client
+// hints a page may adapt its layout to.
+var defaultRequestHeaders = []string{"Accept-Language", "Sec-CH-UA-Mobile", "Sec-CH-UA-Platform"}
+
+// WithRequestInfo sets the headers and cookies server.js sees in
+// __SSR_REQUEST__ instead of SSR_REQUEST_HEADERS and SSR_REQUEST_COOKIES.
+func WithRequestInfo(opts renderer.RequestInfoOptions) RunOption {
+	return func(o *runOptions) {
+		o.requestInfo = &opts
+	}
+}
+
+// requestInfoOptions reads the comma-separated allowlists
+// SSR_REQUEST_HEADERS and SSR_REQUEST_COOKIES. No cookies are allowed by
+// default; "-" allows no headers either.
+func requestInfoOptions() renderer.RequestInfoOptions {
+	opts := renderer.RequestInfoOptions{Headers: defaultRequestHeaders}
+	if raw, ok := os.LookupEnv("SSR_REQUEST_HEADERS"); ok {
+		opts.Headers = splitList(raw)
+	}
+	opts.Cookies = splitList(os.Getenv("SSR_REQUEST_COOKIES"))
+	return opts
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" && v != "-" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// requestInfo describes c for __SSR_REQUEST__, with the client IP as gin
+// resolves it through trusted proxies.
+func (a *ssrApp) requestInfo(c *gin.Context) renderer.RequestInfo {
+	info := renderer.NewRequestInfo(c.Request, a.requestOpts)
+	info.IP = c.ClientIP()
+	return info
+}
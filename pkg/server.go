@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,10 +14,11 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"vitego/pkg/locales"
@@ -32,12 +34,62 @@ type FrontendBuild struct {
 
 type BackendDataFetcher func(context.Context, *http.Request) (SSRPayload, error)
 
+// RunOption configures RunBlocking.
+type RunOption func(*runOptions)
+
+type runOptions struct {
+	routeLabel  func(urlPath string) string
+	cache       *pageCache
+	prerendered fs.FS
+	engine      EngineFactory
+	breaker     *BreakerOptions
+	policy      RenderPolicy
+	requestInfo *renderer.RequestInfoOptions
+}
+
+// WithRouteLabel maps request paths to the route patterns SSR metrics are
+// labelled with. Paths it returns "" for, and all paths without it, are
+// labelled "other" to keep the label set bounded.
+func WithRouteLabel(fn func(urlPath string) string) RunOption {
+	return func(o *runOptions) {
+		o.routeLabel = fn
+	}
+}
+
+func newRunOptions(opts []RunOption) runOptions {
+	var o runOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o runOptions) route(urlPath string) string {
+	if o.routeLabel == nil {
+		return otherRoute
+	}
+	if route := o.routeLabel(urlPath); route != "" {
+		return route
+	}
+	return otherRoute
+}
+
 const DefaultSSRFetchPrefix = "/__ssr_fetch"
 
-var langAttributePattern = regexp.MustCompile(`lang="[^"]*"`)
+const defaultRenderTimeout = 3 * time.Second
+
+// serverEntryName is the entry of the server build inside ServerDist; it may
+// require() code-split chunks next to it.
+const serverEntryName = "server.js"
+
+// appHTMLPlaceholder marks where index.html receives the rendered app.
+const appHTMLPlaceholder = "<!--app-html-->"
+
+// htmlContentType is the Content-Type of every page the app serves, whether
+// rendered, streamed, prerendered or the fallback.
+const htmlContentType = "text/html; charset=utf-8"
 
-func RunBlocking(router *gin.Engine, frontendBuild FrontendBuild, fetcher BackendDataFetcher) {
-	devMode := isDevMode()
+func RunBlocking(router *gin.Engine, frontendBuild FrontendBuild, fetcher BackendDataFetcher, runOpts ...RunOption) {
 	router.GET("/i/:invite_code", func(c *gin.Context) {
 		inviteCode := strings.TrimSpace(c.Param("invite_code"))
 		if inviteCode != "" {
@@ -46,170 +98,364 @@ func RunBlocking(router *gin.Engine, frontendBuild FrontendBuild, fetcher Backen
 		c.Redirect(http.StatusFound, "/")
 	})
 
+	RunApps(router, App{
+		Name:    DefaultAppName,
+		Build:   frontendBuild,
+		Fetcher: fetcher,
+		Options: runOpts,
+	})
+}
+
+// newSSRApp loads index.html and server.js from build.
+func newSSRApp(router *gin.Engine, build FrontendBuild, fetcher BackendDataFetcher, opts runOptions) (*ssrApp, error) {
+	app := &ssrApp{
+		router:      router,
+		renderLimit: renderConcurrencyLimit(),
+		fetcher:     fetcher,
+		opts:        opts,
+		timeout:     renderTimeout(),
+		queueBudget: queueBudget(),
+		requestOpts: requestInfoOptions(),
+		streaming:   streamingEnabled(),
+		overlay:     errorOverlayEnabled(),
+	}
+	if app.renderLimit > 0 {
+		app.sem = make(chan struct{}, app.renderLimit)
+	}
+	if opts.requestInfo != nil {
+		app.requestOpts = *opts.requestInfo
+	}
+
+	b, err := app.loadBundle(build, "embedded")
+	if err != nil {
+		return nil, err
+	}
+	app.bundle.Store(b)
+	return app, nil
+}
+
+// ssrApp renders pages for requests no other route matched.
+type ssrApp struct {
+	name string
+	// prefix is the path the app is mounted under; requests reach it with
+	// the prefix stripped.
+	prefix string
+
+	router      *gin.Engine
+	renderLimit int
+	// bundle is the index.html and renderer pair being served and previous
+	// the retired one a rollback returns to; swapMu serializes swaps.
+	bundle   atomic.Pointer[ssrBundle]
+	previous atomic.Pointer[ssrBundle]
+	swapMu   sync.Mutex
+
+	fetcher   BackendDataFetcher
+	opts      runOptions
+	sem       chan struct{}
+	timeout   time.Duration
+	streaming bool
+	// overlay shows render errors on the fallback page; see SSR_ERROR_OVERLAY.
+	overlay bool
+	cache   *pageCache
+	// prerendered holds pages written by Prerender, served before rendering.
+	prerendered fs.FS
+	// queueBudget is how long a render may wait for a slot before the page
+	// falls back to client-side rendering; 0 waits until the timeout.
+	queueBudget time.Duration
+	breaker     *breaker
+	// renders counts renders running or waiting for a slot, for the policy.
+	renders atomic.Int64
+	// requestOpts selects the headers and cookies in __SSR_REQUEST__.
+	requestOpts renderer.RequestInfoOptions
+	renderLog   renderLog
+}
+
+func (a *ssrApp) handle(c *gin.Context) {
+	page := a.prerenderedPage(c.Request)
+	switch a.decide(c, page) {
+	case RenderPrerendered:
+		c.Data(http.StatusOK, htmlContentType, page)
+		return
+	case RenderCSR:
+		c.Set(csrOnlyKey, true)
+	}
+	if a.cache != nil {
+		c.Set(requestVaryKey, a.cache.vary(c.Request, a.requestInfo(c).Cookies))
+		a.cache.serve(c, a.serve)
+		return
+	}
+	a.serve(c)
+}
+
+// serve fetches the payload and renders the page into c.
+func (a *ssrApp) serve(c *gin.Context) {
+	b := a.acquireBundle()
+	defer b.release()
+	a.serveWith(c, b)
+}
+
+func (a *ssrApp) serveWith(c *gin.Context, b *ssrBundle) {
 	var (
-		indexHTML string
-		ssr       *renderer.Renderer
-		proxy     *httputil.ReverseProxy
-		renderSem chan struct{}
+		payload    SSRPayload
+		payloadMap map[string]any
+		err        error
 	)
 
-	if devMode {
-		proxy = newDevProxy(devServerURL())
-		log.Printf("Development mode enabled. Proxying to %s", devServerURL())
-		router.NoRoute(func(c *gin.Context) {
-			if strings.HasPrefix(c.Request.URL.Path, DefaultSSRFetchPrefix) {
-				c.Status(http.StatusNotFound)
-				return
-			}
+	route := a.opts.route(c.Request.URL.Path)
+	// The CSR shell leaves the data to the client app.
+	csrOnly := c.GetBool(csrOnlyKey)
 
-			proxy.ServeHTTP(c.Writer, c.Request)
-		})
-	} else {
-		indexBytes, err := readFSFile(frontendBuild.FrontendDist, "index.html")
+	if a.fetcher != nil && !csrOnly {
+		fetchStart := time.Now()
+		payload, err = a.fetcher(c.Request.Context(), c.Request)
+		dataFetchDuration.WithLabelValues(renderOutcome(err)).Observe(time.Since(fetchStart).Seconds())
 		if err != nil {
-			log.Fatalf("failed to read index.html: %v", err)
+			log.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
 		}
-		indexHTML = string(indexBytes)
+	}
 
-		serverEntry, err := readFSFile(frontendBuild.ServerDist, "server.js")
-		if err != nil {
-			log.Fatalf("failed to read server.js: %v", err)
-		}
-		ssr = renderer.NewRenderer(string(serverEntry))
-		prewarmRenderer(ssr)
+	payloadMap = payloadToMap(payload)
+	if session := sessionStateFromRequest(c.Request); session != nil {
+		payloadMap["session"] = session
+	}
 
-		renderLimit := renderConcurrencyLimit()
-		if renderLimit > 0 {
-			renderSem = make(chan struct{}, renderLimit)
-		}
+	locale := localeFromPath(c.Request.URL.Path)
+	if locale != "" {
+		payloadMap["locale"] = locale
+	}
 
-		assetsFS, err := fs.Sub(frontendBuild.FrontendDist, "assets")
-		if err != nil {
-			log.Fatalf("failed to prepare assets filesystem: %v", err)
-		}
+	if origin := requestOrigin(c.Request); origin != "" {
+		payloadMap["siteOrigin"] = origin
+	}
 
-		router.StaticFS("/assets", http.FS(assetsFS))
+	if csrOnly {
+		writeShellPage(c, b.doc, payloadMap, locale)
+		return
+	}
 
-		router.NoRoute(func(c *gin.Context) {
-			if strings.HasPrefix(c.Request.URL.Path, DefaultSSRFetchPrefix) {
-				c.Status(http.StatusNotFound)
-				return
-			}
+	reqID := fmt.Sprintf("%d", time.Now().UnixNano())
 
-			var (
-				payload    SSRPayload
-				payloadMap map[string]any
-				err        error
-			)
-
-			if fetcher != nil {
-				payload, err = fetcher(c.Request.Context(), c.Request)
-				if err != nil {
-					log.Println(err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-			}
+	renderCtx := renderer.WithRequest(renderer.WithRequestID(c.Request.Context(), reqID), c.Request)
+	renderCtx = renderer.WithRequestInfo(renderCtx, a.requestInfo(c))
+	renderCtx, cancel := context.WithTimeout(renderCtx, a.timeout)
+	defer cancel()
 
-			payloadMap = payloadToMap(payload)
-			if session := sessionStateFromRequest(c.Request); session != nil {
-				payloadMap["session"] = session
-			}
+	// Crawlers get the buffered page, which has head teleports in <head>.
+	if a.streaming && !IsBot(c.Request.UserAgent()) {
+		a.streamPage(renderCtx, c, b, route, payloadMap, locale, reqID)
+		return
+	}
 
-			locale := localeFromPath(c.Request.URL.Path)
-			if locale != "" {
-				payloadMap["locale"] = locale
-			}
+	result, err := a.render(renderCtx, c, b.ssr, route, payloadMap, nil)
+	if err != nil {
+		if !errors.Is(err, errRenderShed) {
+			log.Printf("ssr render failed id=%s path=%s err=%v", reqID, c.Request.URL.Path, err)
+		}
 
-			if origin := requestOrigin(c.Request); origin != "" {
-				payloadMap["siteOrigin"] = origin
-			}
+		writeFallbackPage(c, b.doc, payloadMap, locale, reqID, a.errorOverlay(err))
+		return
+	}
 
-			reqID := fmt.Sprintf("%d", time.Now().UnixNano())
+	result.Location = a.publicLocation(result.Location)
+	status := applyRenderResponse(c.Writer.Header(), result)
+	if result.Location != "" {
+		c.Status(status)
+		return
+	}
 
-			result, err := renderWithTimeout(ssr, c.Request.URL.Path, payloadMap, 3*time.Second, renderSem)
-			if err != nil {
-				log.Printf("ssr render failed id=%s path=%s err=%v", reqID, c.Request.URL.Path, err)
+	parts := pagePartsFor(result, locale)
+	data, dataErr := ssrDataScript(mergeSSRState(payloadMap, result.State))
+	if dataErr != nil {
+		log.Println(dataErr)
+	}
+	parts.Head += data
 
-				fallback := buildFallbackPage(indexHTML, payloadMap, locale, reqID)
-				c.Header("Content-Type", "text/html")
-				c.String(http.StatusOK, fallback)
-				return
-			}
+	c.Header("Content-Type", htmlContentType)
+	c.String(status, b.doc.render(parts, result.HTML))
+}
 
-			page := strings.Replace(indexHTML, "<!--app-html-->", result.HTML, 1)
-			if locale != "" {
-				page = applyHTMLLang(page, locale)
-			}
-			page = injectHeadContent(page, result.Head)
-			page, injectErr := injectSSRData(page, payloadMap)
-			if injectErr != nil {
-				log.Println(injectErr)
-			}
+// streamPage writes index.html around a streaming render. The shell up to the
+// app placeholder goes out with the first chunk, so a render that fails before
+// producing output still gets the CSR fallback page. Head content set after
+// that point, such as Vue's head teleports, and __SSR_DATA__ are written with
+// the tail, at the end of <body>; crawlers are therefore not streamed.
+func (a *ssrApp) streamPage(ctx context.Context, c *gin.Context, b *ssrBundle, route string, payload map[string]any, locale string, reqID string) {
+	doc := b.doc
+	w := &streamResponse{w: c.Writer, app: a, doc: doc, locale: locale}
+	result, err := a.render(ctx, c, b.ssr, route, payload, w)
+	if w.redirected {
+		return
+	}
+	if err != nil {
+		if !errors.Is(err, errRenderShed) {
+			log.Printf("ssr render failed id=%s path=%s streamed=%t err=%v", reqID, c.Request.URL.Path, w.started, err)
+		}
+
+		if !w.started {
+			writeFallbackPage(c, doc, payload, locale, reqID, a.errorOverlay(err))
+			return
+		}
+
+		// The status line is gone; leave the marker the fallback page would
+		// carry and let the client app mount over the partial markup.
+		c.Set(noCacheKey, true)
+		result.Head = ssrErrorMeta(reqID)
+	}
 
-			c.Header("Content-Type", "text/html")
-			c.String(http.StatusOK, page)
-		})
+	data, dataErr := ssrDataScript(mergeSSRState(payload, result.State))
+	if dataErr != nil {
+		log.Println(dataErr)
+	}
+	_, tail := doc.split(pageParts{BodyEnd: result.Head + result.BodyEnd + data})
+
+	if _, err := io.WriteString(c.Writer, tail); err != nil {
+		log.Printf("ssr stream write failed id=%s path=%s err=%v", reqID, c.Request.URL.Path, err)
 	}
 }
 
-func applyHTMLLang(html string, locale string) string {
-	locale = strings.TrimSpace(locale)
-	if locale == "" {
-		return html
+// streamResponse implements renderer.StreamWriter on top of the gin response.
+type streamResponse struct {
+	w          gin.ResponseWriter
+	app        *ssrApp
+	doc        *document
+	locale     string
+	started    bool
+	redirected bool
+}
+
+func (s *streamResponse) WriteHead(res renderer.Result) error {
+	s.started = true
+	res.Location = s.app.publicLocation(res.Location)
+	status := applyRenderResponse(s.w.Header(), res)
+	if res.Location != "" {
+		s.redirected = true
+		s.w.WriteHeader(status)
+		s.w.WriteHeaderNow()
+		return nil
 	}
 
-	replacement := fmt.Sprintf(`lang="%s"`, locale)
-	if langAttributePattern.MatchString(html) {
-		return langAttributePattern.ReplaceAllString(html, replacement)
+	s.w.Header().Set("Content-Type", htmlContentType)
+	s.w.WriteHeader(status)
+	shell, _ := s.doc.split(pagePartsFor(res, s.locale))
+	return s.write(shell)
+}
+
+func (s *streamResponse) WriteChunk(chunk string) error {
+	if s.redirected {
+		return nil
 	}
+	return s.write(chunk)
+}
 
-	if strings.Contains(html, "<html") {
-		return strings.Replace(html, "<html", "<html "+replacement, 1)
+func (s *streamResponse) write(data string) error {
+	if _, err := io.WriteString(s.w, data); err != nil {
+		return err
 	}
+	s.w.Flush()
+	return nil
+}
 
-	return html
+// reservedRenderHeaders are owned by the server; server.js cannot set them
+// through __SSR_RESPONSE__ headers.
+var reservedRenderHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Location":          true,
+	"Set-Cookie":        true,
+	"Transfer-Encoding": true,
 }
 
-func injectHeadContent(html string, head string) string {
-	if strings.TrimSpace(head) == "" {
-		return html
+// applyRenderResponse copies the headers, cookies and redirect server.js set
+// into h and returns the status code to respond with.
+func applyRenderResponse(h http.Header, result renderer.Result) int {
+	for name, values := range result.Header {
+		if reservedRenderHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+	for _, cookie := range result.Cookies {
+		h.Add("Set-Cookie", cookie)
+	}
+	if result.Location != "" {
+		h.Set("Location", result.Location)
 	}
 
-	injection := head
-	if !strings.HasSuffix(injection, "\n") {
-		injection += "\n"
+	if result.Status != 0 {
+		return result.Status
 	}
+	return http.StatusOK
+}
 
-	if strings.Contains(html, "</head>") {
-		return strings.Replace(html, "</head>", injection+"</head>", 1)
+// pagePartsFor maps a render result onto index.html. The locale from the
+// path sets lang unless server.js set its own html attributes.
+func pagePartsFor(result renderer.Result, locale string) pageParts {
+	htmlAttrs := map[string]string{}
+	if locale = strings.TrimSpace(locale); locale != "" {
+		htmlAttrs["lang"] = locale
+	}
+	for k, v := range result.HTMLAttrs {
+		htmlAttrs[k] = v
 	}
 
-	return injection + html
+	return pageParts{
+		HTMLAttrs: htmlAttrs,
+		BodyAttrs: result.BodyAttrs,
+		Head:      result.Head,
+		BodyEnd:   result.BodyEnd,
+	}
 }
 
-func injectSSRData(html string, payload map[string]any) (string, error) {
+// ssrDataScript serializes payload as the window.__SSR_DATA__ script.
+func ssrDataScript(payload map[string]any) (string, error) {
 	if len(payload) == 0 {
-		return html, nil
+		return "", nil
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return html, err
+		return "", err
 	}
 
 	escaped := template.JSEscapeString(string(jsonData))
-	script := fmt.Sprintf(`<script id="ssr-data">window.__SSR_DATA__=JSON.parse("%s")</script>`, escaped)
+	return fmt.Sprintf(`<script id="ssr-data">window.__SSR_DATA__=JSON.parse("%s")</script>`, escaped), nil
+}
 
-	if strings.Contains(html, "</head>") {
-		return strings.Replace(html, "</head>", script+"</head>", 1), nil
+// errorOverlay returns a panel showing err, stack mapped to the original
+// sources, when the overlay is enabled.
+func (a *ssrApp) errorOverlay(err error) string {
+	if !a.overlay || err == nil {
+		return ""
 	}
+	return `<pre id="ssr-error-overlay" style="position:fixed;inset:auto 0 0 0;z-index:2147483647;max-height:50vh;overflow:auto;margin:0;padding:16px;background:#1e1e1e;color:#ff6b6b;font:12px/1.5 monospace;white-space:pre-wrap" onclick="this.remove()">` +
+		template.HTMLEscapeString("SSR render failed: "+err.Error()) + `</pre>`
+}
+
+func ssrErrorMeta(reqID string) string {
+	return fmt.Sprintf(`<meta name="ssr-error-id" content="%s">`, template.HTMLEscapeString(reqID))
+}
 
-	if strings.Contains(html, "</body>") {
-		return strings.Replace(html, "</body>", script+"</body>", 1), nil
+// mergeSSRState overlays the state server.js left after rendering on the Go
+// payload, so stores filled during SSR reach the client while payload keys
+// the app never touched are kept.
+func mergeSSRState(payload map[string]any, state map[string]any) map[string]any {
+	if len(state) == 0 {
+		return payload
 	}
 
-	return html + script, nil
+	merged := make(map[string]any, len(payload)+len(state))
+	for k, v := range payload {
+		merged[k] = v
+	}
+	for k, v := range state {
+		merged[k] = v
+	}
+	return merged
 }
 
 func payloadToMap(payload SSRPayload) map[string]any {
@@ -349,36 +595,171 @@ func newDevProxy(rawURL string) *httputil.ReverseProxy {
 	return proxy
 }
 
-func renderWithTimeout(ssr *renderer.Renderer, urlPath string, payload map[string]any, timeout time.Duration, sem chan struct{}) (renderer.Result, error) {
-	type renderResult struct {
-		result renderer.Result
-		err    error
-	}
+// render renders c's page behind the circuit breaker and the queue-wait
+// budget; renders either one turns away fail with errRenderShed. Renders are
+// kept in the render log for Diagnose. Smoke renders of a new bundle bypass
+// all of this.
+func (a *ssrApp) render(ctx context.Context, c *gin.Context, ssr renderer.Engine, route string, payload map[string]any, stream renderer.StreamWriter) (result renderer.Result, err error) {
+	if c.GetBool(smokeRenderKey) {
+		return renderWithDeadline(ctx, ssr, route, c.Request.URL.Path, payload, a.sem, 0, stream)
+	}
+	start := time.Now()
+	defer func() { a.logRender(ctx, c, route, start, err) }()
+
+	done, ok := a.breaker.admit()
+	if !ok {
+		rendersShed.WithLabelValues("breaker").Inc()
+		return renderer.Result{}, errBreakerOpen
+	}
+	a.renders.Add(1)
+	defer a.renders.Add(-1)
+
+	// Crawlers wait for a slot until the render times out, as they should
+	// get the rendered page, and go first when renders queue for a worker.
+	budget := a.queueBudget
+	if IsBot(c.Request.UserAgent()) {
+		budget = 0
+		ctx = renderer.WithPriority(ctx, renderer.PriorityHigh)
+	}
+	result, err = renderWithDeadline(ctx, ssr, route, c.Request.URL.Path, payload, a.sem, budget, stream)
+	done(err)
+	return result, err
+}
 
-	ch := make(chan renderResult, 1)
-	go func() {
+// renderWithDeadline renders within the deadline carried by ctx. Waiting for a
+// semaphore slot counts against the same deadline; once it passes, the
+// renderer terminates the running script and drops its isolate. A positive
+// budget caps the wait on its own, failing with errQueueBudget. Renders whose
+// context ends before they start fail with errRenderShed too.
+// Engines with render workers order waiting renders by priority in their
+// own queue, so sem is skipped for them and the budget applies to that
+// queue instead.
+// A non-nil stream receives the HTML as it is rendered. route labels the
+// render duration metric.
+func renderWithDeadline(ctx context.Context, ssr renderer.Engine, route string, urlPath string, payload map[string]any, sem chan struct{}, budget time.Duration, stream renderer.StreamWriter) (result renderer.Result, err error) {
+	var started time.Time
+	defer func() {
+		if !started.IsZero() && !errors.Is(err, errRenderShed) {
+			renderDuration.WithLabelValues(route, renderOutcome(err)).Observe(time.Since(started).Seconds())
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			renderTimeouts.Inc()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errRenderPanic, r)
+		}
+		if errors.Is(err, errRenderPanic) || errors.Is(err, renderer.ErrRenderPanic) {
+			renderPanics.Inc()
+		}
+	}()
+
+	if engineWorkers(ssr) > 0 {
+		sem = nil
+		if budget > 0 {
+			ctx = renderer.WithQueueBudget(ctx, budget)
+		}
 		defer func() {
-			if r := recover(); r != nil {
-				ch <- renderResult{err: fmt.Errorf("panic: %v", r)}
+			if errors.Is(err, renderer.ErrQueueBudget) {
+				rendersShed.WithLabelValues("queue").Inc()
+				err = errQueueBudget
 			}
 		}()
-		if sem != nil {
-			sem <- struct{}{}
-			defer func() { <-sem }()
+	}
+	defer func() {
+		if errors.Is(err, renderer.ErrQueueWait) {
+			err = fmt.Errorf("%w: %w", errRenderShed, err)
 		}
-		res, err := ssr.Render(urlPath, payload)
-		ch <- renderResult{result: res, err: err}
 	}()
 
-	if timeout <= 0 {
-		timeout = 3 * time.Second
+	if sem != nil {
+		var overBudget <-chan time.Time
+		if budget > 0 {
+			t := time.NewTimer(budget)
+			defer t.Stop()
+			overBudget = t.C
+		}
+
+		queueDepth.Inc()
+		waitStart := time.Now()
+		select {
+		case sem <- struct{}{}:
+			queueDepth.Dec()
+			queueWait.Observe(time.Since(waitStart).Seconds())
+			defer func() { <-sem }()
+		case <-overBudget:
+			queueDepth.Dec()
+			queueWait.Observe(time.Since(waitStart).Seconds())
+			rendersShed.WithLabelValues("queue").Inc()
+			return renderer.Result{}, errQueueBudget
+		case <-ctx.Done():
+			queueDepth.Dec()
+			queueWait.Observe(time.Since(waitStart).Seconds())
+			return renderer.Result{}, fmt.Errorf("%w: %w", renderer.ErrQueueWait, ctx.Err())
+		}
+	}
+
+	started = time.Now()
+	if stream != nil {
+		return ssr.RenderStream(ctx, urlPath, payload, stream)
+	}
+	return ssr.Render(ctx, urlPath, payload)
+}
+
+// renderSlots returns how many renders of the current bundle may run at
+// once: its render workers if it has any, otherwise SSR_RENDER_LIMIT.
+func (a *ssrApp) renderSlots() int {
+	if n := engineWorkers(a.bundle.Load().ssr); n > 0 {
+		return n
+	}
+	return a.renderLimit
+}
+
+// engineWorkers returns the render workers of ssr, or 0 for engines that
+// have none.
+func engineWorkers(ssr renderer.Engine) int {
+	if w, ok := ssr.(interface{ Workers() int }); ok {
+		return w.Workers()
+	}
+	return 0
+}
+
+func renderTimeout() time.Duration {
+	if raw := strings.TrimSpace(os.Getenv("SSR_RENDER_TIMEOUT")); raw != "" {
+		if v, err := time.ParseDuration(raw); err == nil && v > 0 {
+			return v
+		}
 	}
+	return defaultRenderTimeout
+}
+
+// queueBudget reads SSR_QUEUE_BUDGET, the longest a render waits for a slot
+// before the page falls back to client-side rendering.
+func queueBudget() time.Duration {
+	v, _ := envDuration("SSR_QUEUE_BUDGET")
+	return v
+}
 
-	select {
-	case r := <-ch:
-		return r.result, r.err
-	case <-time.After(timeout):
-		return renderer.Result{}, fmt.Errorf("render timeout after %s", timeout)
+// streamingEnabled reports whether SSR_STREAMING asks for streamed responses.
+func streamingEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("SSR_STREAMING"))) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// errorOverlayEnabled reports whether SSR_ERROR_OVERLAY asks for render
+// errors on the fallback page. Stacks leak source paths, so it is meant for
+// local runs of the production build only.
+func errorOverlayEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("SSR_ERROR_OVERLAY"))) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
 	}
 }
 
@@ -391,27 +772,80 @@ func renderConcurrencyLimit() int {
 	return runtime.GOMAXPROCS(0)
 }
 
-func prewarmRenderer(ssr *renderer.Renderer) {
+// fetchOptions configures fetch() inside renders. SSR_FETCH_ALLOW overrides
+// the allowed path prefixes and SSR_FETCH_BUDGET the per-render request cap.
+// SSR_FETCH_TOKEN is forwarded so the token guard on DefaultSSRFetchPrefix
+// accepts in-process requests.
+func fetchOptions() renderer.FetchOptions {
+	opts := renderer.FetchOptions{
+		AllowedPrefixes: []string{"/api/", DefaultSSRFetchPrefix + "/"},
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("SSR_FETCH_ALLOW")); raw != "" {
+		opts.AllowedPrefixes = nil
+		for _, prefix := range strings.Split(raw, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				opts.AllowedPrefixes = append(opts.AllowedPrefixes, prefix)
+			}
+		}
+	}
+	if v, ok := envInt("SSR_FETCH_BUDGET"); ok {
+		opts.MaxRequests = v
+	}
+	if token := strings.TrimSpace(os.Getenv("SSR_FETCH_TOKEN")); token != "" {
+		opts.Header = http.Header{"X-Ssr-Token": []string{token}}
+	}
+
+	return opts
+}
+
+func envInt(name string) (int, bool) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return 0, false
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+func prewarmRenderer(ssr renderer.Engine) {
 	go func() {
-		_, _ = ssr.Render("/", nil)
+		ctx, cancel := context.WithTimeout(context.Background(), renderTimeout())
+		defer cancel()
+		_, _ = ssr.Render(ctx, "/", nil)
 	}()
 }
 
-func buildFallbackPage(indexHTML string, payload map[string]any, locale string, reqID string) string {
-	page := strings.Replace(indexHTML, "<!--app-html-->", `<div id="app"></div>`, 1)
-	if locale != "" {
-		page = applyHTMLLang(page, locale)
-	}
+// writeFallbackPage serves the client-side rendered page after a failed render.
+// overlay, when not empty, is added to the end of <body>.
+func writeFallbackPage(c *gin.Context, doc *document, payload map[string]any, locale string, reqID string, overlay string) {
+	renderFallbacks.Inc()
+	c.Set(noCacheKey, true)
+	c.Header("Content-Type", htmlContentType)
+	c.String(http.StatusOK, buildFallbackPage(doc, payload, locale, reqID, overlay))
+}
+
+// writeShellPage writes the CSR shell the render policy chose. Unlike a
+// fallback page it is no failed render, so it is not counted as one.
+func writeShellPage(c *gin.Context, doc *document, payload map[string]any, locale string) {
+	c.Set(noCacheKey, true)
+	c.Header("Content-Type", htmlContentType)
+	c.String(http.StatusOK, buildFallbackPage(doc, payload, locale, "", ""))
+}
 
-	headMeta := ""
+func buildFallbackPage(doc *document, payload map[string]any, locale string, reqID string, overlay string) string {
+	parts := pagePartsFor(renderer.Result{}, locale)
+	parts.BodyEnd = overlay
 	if strings.TrimSpace(reqID) != "" {
-		headMeta = fmt.Sprintf(`<meta name="ssr-error-id" content="%s">`, template.HTMLEscapeString(reqID))
-		page = injectHeadContent(page, headMeta)
+		parts.Head = ssrErrorMeta(reqID) + "\n"
 	}
 
-	if injected, err := injectSSRData(page, payload); err == nil {
-		return injected
+	if data, err := ssrDataScript(payload); err == nil {
+		parts.Head += data
 	}
 
-	return page
+	return doc.render(parts, `<div id="app"></div>`)
 }
@@ -0,0 +1,22 @@
+// SsrRequest mirrors the read-only __SSR_REQUEST__ global the Go renderer
+// defines before server.js runs. Only the headers and cookies allowed by
+// SSR_REQUEST_HEADERS and SSR_REQUEST_COOKIES are present.
+export interface SsrRequest {
+  readonly method: string
+  readonly url: string
+  readonly path: string
+  readonly query: Readonly<Record<string, readonly string[]>>
+  readonly host: string
+  readonly ip: string
+  readonly userAgent: string
+  // headers is keyed by lowercase header name.
+  readonly headers: Readonly<Record<string, string>>
+  readonly cookies: Readonly<Record<string, string>>
+}
+
+// useSsrRequest returns the request being rendered, or null in the browser.
+export function useSsrRequest(): SsrRequest | null {
+  if (typeof window !== 'undefined')
+    return null
+  return (globalThis as any).__SSR_REQUEST__ ?? null
+}
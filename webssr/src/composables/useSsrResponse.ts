@@ -0,0 +1,22 @@
+// SsrResponse mirrors the __SSR_RESPONSE__ global the Go renderer installs
+// before server.js runs. It is read back after rendering to set the HTTP
+// status, redirect, headers and cookies of the response.
+export interface SsrResponse {
+  status: number
+  location: string
+  headers: [string, string][]
+  cookies: string[]
+  setStatus: (code: number) => void
+  redirect: (location: string, status?: number) => void
+  setHeader: (name: string, value: string) => void
+  appendHeader: (name: string, value: string) => void
+  setCookie: (cookie: string) => void
+}
+
+// useSsrResponse returns the response of the current render, or null in the
+// browser.
+export function useSsrResponse(): SsrResponse | null {
+  if (typeof window !== 'undefined')
+    return null
+  return (globalThis as any).__SSR_RESPONSE__ ?? null
+}
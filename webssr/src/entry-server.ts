@@ -1,25 +1,117 @@
-import { renderToString } from '@vue/server-renderer'
+import { renderToSimpleStream, renderToString } from '@vue/server-renderer'
+import { nextTick } from 'vue'
 
 import { makeApp } from '~/main'
-import type { SsrState } from '~/composables/useSsrData'
+import type { SsrDataContext, SsrState } from '~/composables/useSsrData'
+import { useSsrRequest } from '~/composables/useSsrRequest'
+import { useSsrResponse } from '~/composables/useSsrResponse'
+import { getLocaleRef } from '~/modules/i18n'
 
-export async function render(url: string) {
+// SsrHead is the structured form of globalThis.__SSR_HEAD__ read by the Go
+// renderer. Attributes are merged into index.html's <html> and <body> tags.
+interface SsrHead {
+  head?: string
+  htmlAttrs?: Record<string, string | boolean | null | undefined>
+  bodyAttrs?: Record<string, string | boolean | null | undefined>
+  bodyEnd?: string
+}
+
+function setHead(head: SsrHead) {
+  (globalThis as any).__SSR_HEAD__ = head
+}
+
+// prepare returns null when navigation was redirected, e.g. by the locale
+// guard; the redirect is then reported through __SSR_RESPONSE__.
+async function prepare(url: string) {
   const initialState: SsrState = (globalThis as any).__SSR_DATA__ ?? {}
-  const { app, router } = makeApp(initialState)
+  const { app, router, ssrContext, i18n } = makeApp(initialState)
   await router.push(url)
 
-  const ctx: any = {}
+  // Attributes are set before rendering so a streamed shell carries them.
+  const htmlAttrs = { lang: getLocaleRef(i18n).value }
+  setHead({ htmlAttrs })
+
+  const current = router.currentRoute.value
+  if (!samePath(current.path, url)) {
+    useSsrResponse()?.redirect(current.fullPath, 302)
+    return null
+  }
 
-  ;(globalThis as any).__SSR_HEAD__ = ''
-  const html = await renderToString(app, ctx)
-  const head = typeof ctx.teleports?.head === 'string' ? ctx.teleports.head : ''
-  ;(globalThis as any).__SSR_HEAD__ = head
+  return { app, ssrContext, htmlAttrs }
+}
+
+// publishState hands the state stores reached during rendering to Go, which
+// injects it as window.__SSR_DATA__. The deep Pinia watcher in main.ts is
+// flushed first so late store writes are included.
+async function publishState(ssrContext: SsrDataContext) {
+  await nextTick()
+  ;(globalThis as any).__SSR_STATE__ = ssrContext.state.value
+}
+
+// samePath compares the router's encoded path with the decoded one Go hands
+// to ssrRender, so non-ASCII paths do not redirect to themselves.
+function samePath(routed: string, requested: string) {
+  try {
+    return decodeURI(routed) === decodeURI(requested)
+  }
+  catch {
+    return routed === requested
+  }
+}
+
+// teleported maps Vue's SSR teleports onto head and body-end slots.
+function teleported(ctx: any): Pick<SsrHead, 'head' | 'bodyEnd'> {
+  const teleports = ctx.teleports ?? {}
+  return {
+    head: typeof teleports.head === 'string' ? teleports.head : '',
+    bodyEnd: typeof teleports.body === 'string' ? teleports.body : '',
+  }
+}
+
+export async function render(url: string) {
+  const prepared = await prepare(url)
+  if (!prepared)
+    return ''
+
+  const ctx: any = { request: useSsrRequest() }
+  const html = await renderToString(prepared.app, ctx)
+  setHead({ htmlAttrs: prepared.htmlAttrs, ...teleported(ctx) })
+  await publishState(prepared.ssrContext)
 
   return html
 }
 
+// renderStream hands chunks to write as Vue produces them. Teleports are only
+// known once the stream ends, so teleported head content is written at the
+// end of <body>.
+export async function renderStream(url: string, write: (chunk: string) => void) {
+  const prepared = await prepare(url)
+  if (!prepared)
+    return
+
+  const ctx: any = { request: useSsrRequest() }
+  await new Promise<void>((resolve, reject) => {
+    renderToSimpleStream(prepared.app, ctx, {
+      push(chunk) {
+        if (chunk === null)
+          resolve()
+        else
+          write(chunk)
+      },
+      destroy: reject,
+    })
+  })
+  setHead({ htmlAttrs: prepared.htmlAttrs, ...teleported(ctx) })
+  await publishState(prepared.ssrContext)
+}
+
 async function ssrRender(url: string) {
   return await render(url)
 }
 
+async function ssrRenderStream(url: string, write: (chunk: string) => void) {
+  await renderStream(url, write)
+}
+
 (globalThis as any).ssrRender = ssrRender
+;(globalThis as any).ssrRenderStream = ssrRenderStream
@@ -4,6 +4,8 @@ import config from './vite.config'
 export default defineConfig({
   ...config,
   build: {
+    // server.js.map stays on the server; the Go renderer maps error stacks with it.
+    sourcemap: true,
     rollupOptions: {
       input: {
         server: 'src/entry-server.ts',
@@ -11,7 +13,7 @@ export default defineConfig({
       output: {
         format: 'cjs',
         entryFileNames: '[name].js',
-        inlineDynamicImports: true,
+        chunkFileNames: 'chunks/[name]-[hash].js',
       },
     },
   },